@@ -0,0 +1,174 @@
+package compress
+
+/*
+gin-compress Copyright (C) 2022 Aurora McGinnis
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// IDENTITY is the content coding that indicates no transformation
+	IDENTITY = "identity"
+	// WILDCARD matches any content coding not explicitly listed in Accept-Encoding
+	WILDCARD = "*"
+)
+
+// maxQ is the largest q-value, in thousandths
+const maxQ = 1000
+
+// ErrMalformedAcceptEncoding is returned (wrapped) by ParseAcceptEncoding when the header does not match the RFC 9110 grammar
+var ErrMalformedAcceptEncoding = errors.New("malformed Accept-Encoding")
+
+// AcceptedEncoding is a single element of an Accept-Encoding header
+type AcceptedEncoding struct {
+	// Coding is the lower-cased content coding, IDENTITY, or WILDCARD. x-gzip is reported as gzip.
+	Coding string
+	// Q is the q-value of the coding in thousandths, from 0 to 1000
+	Q int
+}
+
+// AcceptEncoding is the parsed form of an Accept-Encoding header, in the order the codings were listed
+type AcceptEncoding []AcceptedEncoding
+
+// ParseAcceptEncoding parses the value of an Accept-Encoding header as specified by RFC 9110 section 12.5.3.
+// Multiple header lines should be joined with a comma before calling this.
+func ParseAcceptEncoding(header string) (AcceptEncoding, error) {
+	elements := strings.Split(header, ",")
+	ae := make(AcceptEncoding, 0, len(elements))
+
+	for _, element := range elements {
+		element = trimOWS(element)
+		if element == "" {
+			// empty list elements are permitted by the #rule
+			continue
+		}
+
+		parts := strings.Split(element, ";")
+		acc := AcceptedEncoding{
+			Coding: normalizeCoding(trimOWS(parts[0])),
+			Q:      maxQ,
+		}
+		if !isToken(acc.Coding) {
+			return nil, fmt.Errorf("%w: invalid coding %q", ErrMalformedAcceptEncoding, parts[0])
+		}
+
+		for _, param := range parts[1:] {
+			param = trimOWS(param)
+			if len(param) < 2 || param[1] != '=' || (param[0] != 'q' && param[0] != 'Q') {
+				// the grammar only defines the weight parameter, anything else is ignored
+				continue
+			}
+
+			q, ok := parseQValue(param[2:])
+			if !ok {
+				return nil, fmt.Errorf("%w: invalid q-value %q for %s", ErrMalformedAcceptEncoding, param[2:], acc.Coding)
+			}
+			acc.Q = q
+		}
+
+		ae = append(ae, acc)
+	}
+
+	return ae, nil
+}
+
+// Weight returns the q-value that the client assigned to coding, falling back to the wildcard for codings that
+// are not explicitly listed. ok is false if neither the coding nor the wildcard were listed.
+func (ae AcceptEncoding) Weight(coding string) (q int, ok bool) {
+	coding = normalizeCoding(coding)
+
+	wildcard, hasWildcard := 0, false
+	for _, acc := range ae {
+		if acc.Coding == coding {
+			return acc.Q, true
+		} else if acc.Coding == WILDCARD && !hasWildcard {
+			wildcard, hasWildcard = acc.Q, true
+		}
+	}
+
+	return wildcard, hasWildcard
+}
+
+// Accepts returns true if the client will accept a response encoded with coding
+func (ae AcceptEncoding) Accepts(coding string) bool {
+	q, ok := ae.Weight(coding)
+	if !ok && normalizeCoding(coding) == IDENTITY {
+		// identity is acceptable unless it is explicitly excluded
+		return true
+	}
+
+	return q > 0
+}
+
+// IdentityAllowed returns false if the client forbade uncompressed responses using identity;q=0 or *;q=0
+func (ae AcceptEncoding) IdentityAllowed() bool {
+	return ae.Accepts(IDENTITY)
+}
+
+// parseQValue parses a qvalue as defined by RFC 9110 section 12.4.2, returning the value in thousandths
+func parseQValue(s string) (int, bool) {
+	if len(s) == 0 || len(s) > 5 || (s[0] != '0' && s[0] != '1') {
+		return 0, false
+	}
+
+	q := int(s[0]-'0') * maxQ
+	if len(s) == 1 {
+		return q, true
+	}
+	if s[1] != '.' {
+		return 0, false
+	}
+
+	scale := maxQ / 10
+	for _, ch := range s[2:] {
+		if ch < '0' || ch > '9' || (q == maxQ && ch != '0') {
+			return 0, false
+		}
+		q += int(ch-'0') * scale
+		scale /= 10
+	}
+
+	return q, true
+}
+
+// normalizeCoding lower-cases a content coding and maps the deprecated x-gzip alias to gzip
+func normalizeCoding(coding string) string {
+	coding = strings.ToLower(coding)
+	if coding == "x-gzip" {
+		return GZIP
+	}
+
+	return coding
+}
+
+// trimOWS strips optional whitespace (spaces and horizontal tabs) from both ends of s
+func trimOWS(s string) string {
+	return strings.Trim(s, " \t")
+}
+
+// isToken returns true if s is a non-empty token as defined by RFC 9110 section 5.6.2
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' {
+			continue
+		}
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", rune(ch)) {
+			return false
+		}
+	}
+
+	return true
+}
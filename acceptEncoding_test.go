@@ -0,0 +1,98 @@
+package compress_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aurowora/compress"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+gin-compress Copyright (C) 2022 Aurora McGinnis
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+
+func TestParseAcceptEncoding(t *testing.T) {
+	ae, err := compress.ParseAcceptEncoding("GZIP;q=0.5,\tbr ; q=1.0, , x-gzip;level=3;Q=0.25, *;q=0")
+	assert.NoError(t, err)
+	assert.Equal(t, compress.AcceptEncoding{
+		{Coding: "gzip", Q: 500},
+		{Coding: "br", Q: 1000},
+		{Coding: "gzip", Q: 250},
+		{Coding: "*", Q: 0},
+	}, ae)
+
+	q, ok := ae.Weight("x-gzip")
+	assert.True(t, ok)
+	assert.Equal(t, 500, q)
+
+	q, ok = ae.Weight("zstd")
+	assert.True(t, ok)
+	assert.Equal(t, 0, q)
+	assert.False(t, ae.IdentityAllowed())
+}
+
+func TestParseAcceptEncodingMalformed(t *testing.T) {
+	for _, header := range []string{
+		"gzip;q=1.5",
+		"gzip;q=1.001",
+		"gzip;q=0.1234",
+		"gzip;q=.5",
+		"gzip;q=",
+		"gz ip",
+		"gzip, ;q=1",
+	} {
+		_, err := compress.ParseAcceptEncoding(header)
+		assert.True(t, errors.Is(err, compress.ErrMalformedAcceptEncoding), header)
+	}
+}
+
+func TestIdentitySemantics(t *testing.T) {
+	cases := map[string]bool{
+		"":                           true,
+		"gzip":                       true,
+		"identity;q=0":               false,
+		"*;q=0":                      false,
+		"*;q=0, identity":            true,
+		"identity;q=0.001, *;q=0":    true,
+		"br, identity;q=0, *;q=0.5":  false,
+		"br;q=0.5, IDENTITY;q=0.000": false,
+	}
+
+	for header, allowed := range cases {
+		ae, err := compress.ParseAcceptEncoding(header)
+		assert.NoError(t, err)
+		assert.Equal(t, allowed, ae.IdentityAllowed(), header)
+	}
+}
+
+func TestNegotiation(t *testing.T) {
+	cases := map[string]string{
+		"*":                         "br",
+		"*;q=0.5, gzip":             "gzip",
+		"gzip;q=0.5, *;q=0.8":       "br",
+		"br;q=0, *":                 "gzip",
+		"x-gzip":                    "gzip",
+		"gzip;q=0.5, identity":      "",
+		"gzip, identity":            "gzip",
+		"gzip;q=2":                  "",
+		"br;q=0, gzip;q=0, *;q=0.1": "zstd",
+	}
+
+	r := setupRouter(compress.WithAlgo(compress.DEFLATE, false))
+	for header, expected := range cases {
+		req, _ := http.NewRequest("GET", "/large", nil)
+		req.Header.Set("Accept-Encoding", header)
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, expected, w.Header().Get("Content-Encoding"), header)
+	}
+}
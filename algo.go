@@ -3,6 +3,7 @@ package compress
 import (
 	"io"
 	"io/ioutil"
+	"strings"
 	"sync"
 )
 
@@ -14,38 +15,123 @@ License, v. 2.0. If a copy of the MPL was not distributed with this
 file, You can obtain one at https://mozilla.org/MPL/2.0/.
 */
 
-// algorithmConfig specifies options for a given compression algorithm
-type algorithmConfig struct {
-	// enable indicates whether or not this compressor should be used
-	enable bool
-	// compressLevel is passed to the encoder object
-	compressLevel int
-	// priority indicates which algorithm will be selected when the client accepts multiple algorithms with equal q values
-	priority int
+// AlgorithmConfig specifies options for a given compression algorithm
+type AlgorithmConfig struct {
+	// Enable indicates whether or not this compressor should be used
+	Enable bool
+	// CompressLevel is passed to the encoder object
+	CompressLevel int
+	// Priority indicates which algorithm will be selected when the client accepts multiple algorithms with equal q values
+	Priority int
 }
 
-type algorithm interface {
-	// returns a compressor for this algorithm
-	getWriter(w io.Writer) io.WriteCloser
-	// returns a decompressor for this algorithm
-	getReader(r io.Reader) io.ReadCloser
-	// returns a pointer to the configuration struct
-	getConfig() *algorithmConfig
+// Algorithm is implemented by every content coding that the middleware can negotiate for responses and undo
+// for request bodies. Implementations are owned by a single middleware, but must be safe for concurrent use by
+// the requests it serves.
+type Algorithm interface {
+	// GetWriter returns a compressor for this algorithm that writes to w. If the compressor has a
+	// Flush() error method, it is called whenever the handler flushes the response.
+	GetWriter(w io.Writer) io.WriteCloser
+	// GetReader returns a decompressor for this algorithm that reads from r. An error should be returned if the
+	// stream is invalid, rather than panicking.
+	GetReader(r io.Reader) (io.ReadCloser, error)
+	// GetConfig returns a pointer to the configuration struct
+	GetConfig() *AlgorithmConfig
 }
 
-// algoritms contains the supported algorithms
-var algorithms = map[string]algorithm{
-	ZSTD:    newAlgorithmZstd(),
-	GZIP:    newAlgorithmGzip(),
-	BROTLI:  newAlgorithmBrotli(),
-	DEFLATE: newAlgorithmDeflate(),
+// Leveler is implemented by algorithms that can run at more than one compression level in the same middleware, as
+// needed by WithLargeCompressLevel and AlgorithmChooser. The built-in algorithms implement it.
+type Leveler interface {
+	// WithLevel returns a new instance with the same configuration except for CompressLevel, which is set to level.
+	// The instance must not share compressors with the original, as they are configured for a different level.
+	WithLevel(level int) Algorithm
 }
 
-func getEnabledAlgorithms() map[string]algorithm {
-	algos := make(map[string]algorithm, len(algorithms))
+// withLevel returns a separate instance of algo that compresses at level, or nil if algo doesn't implement Leveler
+func withLevel(algo Algorithm, level int) Algorithm {
+	if l, ok := algo.(Leveler); ok {
+		return l.WithLevel(level)
+	}
+
+	return nil
+}
+
+// AlgorithmFactory creates a new Algorithm instance. It is called once for every middleware created by Compress().
+type AlgorithmFactory func() Algorithm
+
+var (
+	// algorithmFactoriesMu guards algorithmFactories
+	algorithmFactoriesMu sync.RWMutex
+	// algorithmFactories contains constructors for the globally registered algorithms
+	algorithmFactories = map[string]AlgorithmFactory{
+		ZSTD:    func() Algorithm { return newAlgorithmZstd() },
+		GZIP:    func() Algorithm { return newAlgorithmGzip() },
+		BROTLI:  func() Algorithm { return newAlgorithmBrotli() },
+		DEFLATE: func() Algorithm { return newAlgorithmDeflate() },
+	}
+)
+
+// RegisterAlgorithm makes the algorithm created by factory available to every middleware created after this call
+// under the content coding name, which must be a token other than identity, * or x-gzip. Registering a name that is already in use replaces the existing algorithm.
+// The returned function undoes the registration, restoring the algorithm that was replaced, if any. Middlewares that
+// were already created are unaffected by either. To add an algorithm to a single middleware, see WithAlgorithm.
+func RegisterAlgorithm(name string, factory AlgorithmFactory) (unregister func()) {
+	if !isAlgorithmName(name) || factory == nil {
+		panic("RegisterAlgorithm requires a valid content coding name and a non-nil factory")
+	}
+	name = strings.ToLower(name)
+
+	algorithmFactoriesMu.Lock()
+	defer algorithmFactoriesMu.Unlock()
+
+	replaced, hadReplaced := algorithmFactories[name]
+	algorithmFactories[name] = factory
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			algorithmFactoriesMu.Lock()
+			defer algorithmFactoriesMu.Unlock()
+
+			if hadReplaced {
+				algorithmFactories[name] = replaced
+			} else {
+				delete(algorithmFactories, name)
+			}
+		})
+	}
+}
+
+// isAlgorithmName returns true if name may be used as the content coding of an algorithm. identity and * have special
+// meanings in Accept-Encoding, and x-gzip is treated as gzip, so none of them can be negotiated as a coding of its own.
+func isAlgorithmName(name string) bool {
+	switch strings.ToLower(name) {
+	case IDENTITY, WILDCARD, "x-gzip":
+		return false
+	}
+
+	return isToken(name)
+}
+
+// newAlgorithms creates a fresh set of algorithm instances, so that each middleware has its own pools and configs
+func newAlgorithms() map[string]Algorithm {
+	algorithmFactoriesMu.RLock()
+	defer algorithmFactoriesMu.RUnlock()
+
+	algos := make(map[string]Algorithm, len(algorithmFactories))
+
+	for k, newAlgo := range algorithmFactories {
+		algos[k] = newAlgo()
+	}
+
+	return algos
+}
+
+func getEnabledAlgorithms(algorithms map[string]Algorithm) map[string]Algorithm {
+	algos := make(map[string]Algorithm, len(algorithms))
 
 	for k, v := range algorithms {
-		if v.getConfig().enable {
+		if v.GetConfig().Enable {
 			algos[k] = v
 		}
 	}
@@ -63,11 +149,23 @@ type resettableCompressor interface {
 	Reset(w io.Writer)
 }
 
+// flusher is implemented by compressors that can write out any pending data without ending the stream
+type flusher interface {
+	Flush() error
+}
+
 type resettableDecompressor interface {
 	io.Reader
 	Reset(r io.Reader) error
 }
 
+// eofReader is used to release a decompressor's reference to the request body when it cannot be Reset with nil
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
 type wrappedWriter struct {
 	w resettableCompressor
 	p *sync.Pool
@@ -82,9 +180,18 @@ func (w *wrappedWriter) Write(b []byte) (int, error) {
 	return w.w.Write(b)
 }
 
+func (w *wrappedWriter) Flush() error {
+	if f, ok := w.w.(flusher); ok {
+		return f.Flush()
+	}
+
+	return nil
+}
+
 func (w *wrappedWriter) Close() error {
 	if w.c {
-		panic("attempted to close a compressor that has already been closed")
+		// the compressor may already belong to someone else
+		return nil
 	}
 
 	w.c = true
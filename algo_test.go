@@ -0,0 +1,168 @@
+package compress_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aurowora/compress"
+	"github.com/klauspost/compress/flate"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+gin-compress Copyright (C) 2022 Aurora McGinnis
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+
+// rawFlate is a custom algorithm that uses raw deflate streams without the zlib framing
+type rawFlate struct {
+	cfg compress.AlgorithmConfig
+}
+
+func newRawFlate() compress.Algorithm {
+	return &rawFlate{
+		cfg: compress.AlgorithmConfig{
+			Enable:        true,
+			CompressLevel: compress.GzFlateDefault,
+			Priority:      1000,
+		},
+	}
+}
+
+func (a *rawFlate) GetWriter(w io.Writer) io.WriteCloser {
+	fw, err := flate.NewWriter(w, a.cfg.CompressLevel)
+	if err != nil {
+		panic(err)
+	}
+
+	return fw
+}
+
+func (a *rawFlate) GetReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+func (a *rawFlate) GetConfig() *compress.AlgorithmConfig {
+	return &a.cfg
+}
+
+func TestCustomAlgorithm(t *testing.T) {
+	r := setupRouter(compress.WithAlgorithm("x-raw-deflate", newRawFlate()))
+
+	req, _ := http.NewRequest("GET", "/large", nil)
+	req.Header.Add("Accept-Encoding", "gzip, x-raw-deflate")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	checkCompress(t, w, "x-raw-deflate")
+
+	b := bytes.NewBuffer(nil)
+	_, err := io.Copy(b, flate.NewReader(w.Body))
+	assert.NoError(t, err)
+	assert.Equal(t, largeBody, b.String())
+}
+
+func TestCustomAlgorithmDecompress(t *testing.T) {
+	r := setupRouter(compress.WithAlgorithm("x-raw-deflate", newRawFlate()))
+
+	b := bytes.NewBuffer(nil)
+	fw, err := flate.NewWriter(b, flate.DefaultCompression)
+	assert.NoError(t, err)
+	_, err = fw.Write([]byte(lol))
+	assert.NoError(t, err)
+	assert.NoError(t, fw.Close())
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("POST", "/echo", b)
+	req.Header.Set("Content-Encoding", "x-raw-deflate")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, "", w.Header().Get("X-Request-Content-Encoding"))
+	assert.Equal(t, "200", fmt.Sprintf("%v", w.Code))
+	assert.Equal(t, lol, w.Body.String())
+}
+
+func TestRegisterAlgorithm(t *testing.T) {
+	before := setupRouter()
+	t.Cleanup(compress.RegisterAlgorithm("x-registered-deflate", newRawFlate))
+	after := setupRouter()
+
+	req, _ := http.NewRequest("GET", "/large", nil)
+	req.Header.Add("Accept-Encoding", "x-registered-deflate")
+
+	w := httptest.NewRecorder()
+	before.ServeHTTP(w, req)
+	checkNoop(t, w)
+
+	w = httptest.NewRecorder()
+	after.ServeHTTP(w, req)
+	checkCompress(t, w, "x-registered-deflate")
+}
+
+func TestUnregisterAlgorithm(t *testing.T) {
+	unregister := compress.RegisterAlgorithm(compress.GZIP, newRawFlate)
+	replaced := setupRouter()
+	unregister()
+	restored := setupRouter()
+
+	req, _ := http.NewRequest("GET", "/large", nil)
+	req.Header.Add("Accept-Encoding", "gzip")
+
+	w := httptest.NewRecorder()
+	replaced.ServeHTTP(w, req)
+	checkCompress(t, w, "gzip")
+
+	b := bytes.NewBuffer(nil)
+	_, err := io.Copy(b, flate.NewReader(w.Body))
+	assert.NoError(t, err)
+	assert.Equal(t, largeBody, b.String())
+
+	// the built-in gzip is back
+	w = httptest.NewRecorder()
+	restored.ServeHTTP(w, req)
+	checkCompress(t, w, "gzip")
+	assert.Equal(t, largeBody, decode(t, "gzip", w.Body.Bytes()))
+}
+
+func TestAlgorithmNames(t *testing.T) {
+	for _, name := range []string{"", "identity", "*", "x-gzip", "X-GZIP", "not a token", "x/raw"} {
+		assert.Panics(t, func() {
+			compress.WithAlgorithm(name, newRawFlate())
+		}, name)
+		assert.Panics(t, func() {
+			compress.RegisterAlgorithm(name, newRawFlate)
+		}, name)
+	}
+
+	// options that refer to an algorithm are case-insensitive
+	r := setupRouter(
+		compress.WithAlgo("GZIP", false),
+		compress.WithPriority("Zstd", 1000),
+		compress.WithCompressLevel("BR", compress.BrotliBestSpeed))
+
+	req, _ := http.NewRequest("GET", "/large", nil)
+	req.Header.Add("Accept-Encoding", "gzip, br, zstd")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	checkCompress(t, w, "zstd")
+
+	for _, opt := range []compress.CompressOption{
+		compress.WithAlgo("snappy", false),
+		compress.WithPriority("snappy", 1),
+		compress.WithCompressLevel("snappy", 1),
+	} {
+		assert.Panics(t, func() {
+			compress.Compress(opt)
+		})
+	}
+}
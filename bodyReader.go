@@ -1,6 +1,12 @@
 package compress
 
-import "io"
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
 
 /*
 gin-compress Copyright (C) 2022 Aurora McGinnis
@@ -10,13 +16,90 @@ License, v. 2.0. If a copy of the MPL was not distributed with this
 file, You can obtain one at https://mozilla.org/MPL/2.0/.
 */
 
+// DecompressionLimitError is returned when reading a request body that exceeds the limits set using
+// WithMaxDecompressedBytes or WithMaxDecompressionRatio
+type DecompressionLimitError struct {
+	// Compressed is the number of bytes that were read from the client when the limit was hit
+	Compressed int64
+	// Decompressed is the number of bytes that were produced when the limit was hit
+	Decompressed int64
+	// Ratio is true if the limit was exceeded because of the expansion ratio rather than the absolute size
+	Ratio bool
+}
+
+func (e *DecompressionLimitError) Error() string {
+	if e.Ratio {
+		return fmt.Sprintf("request body exceeded the maximum expansion ratio (%d bytes decompressed from %d)", e.Decompressed, e.Compressed)
+	}
+
+	return fmt.Sprintf("request body exceeded the maximum decompressed size (%d bytes decompressed from %d)", e.Decompressed, e.Compressed)
+}
+
+// countingReader counts the bytes read from the client. Some decompressors read from their source on another
+// goroutine, so the count is accessed atomically.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	atomic.AddInt64(&cr.n, int64(n))
+	return n, err
+}
+
+func (cr *countingReader) count() int64 {
+	return atomic.LoadInt64(&cr.n)
+}
+
 // compressedBodyReader wraps the decompressors so that they all are properly closed
 type compressedBodyReader struct {
 	decomps []io.ReadCloser // must be ordered such that the last item in the slice is the last reader
+	source  *countingReader // wraps the original request body
+
+	// maxBytes is the largest number of decompressed bytes that may be read, or <= 0 for no limit
+	maxBytes int64
+	// maxRatio is the largest allowed ratio of decompressed to compressed bytes, or <= 0 for no limit
+	maxRatio float64
+	// minRatioBytes is the number of decompressed bytes that may be read before maxRatio is enforced
+	minRatioBytes int64
+	// read is the number of decompressed bytes read so far
+	read int64
+	// limitErr is set once either limit has been exceeded
+	limitErr *DecompressionLimitError
 }
 
 func (c *compressedBodyReader) Read(b []byte) (int, error) {
-	return c.decomps[len(c.decomps)-1].Read(b)
+	if c.limitErr != nil {
+		return 0, c.limitErr
+	}
+
+	n, err := c.decomps[len(c.decomps)-1].Read(b)
+	c.read += int64(n)
+
+	if c.maxBytes > 0 && c.read > c.maxBytes {
+		// only hand out the bytes that fit within the limit
+		n -= int(c.read - c.maxBytes)
+		c.read = c.maxBytes
+		c.limitErr = &DecompressionLimitError{Compressed: c.source.count(), Decompressed: c.read}
+		return n, c.limitErr
+	}
+
+	if compressed := c.source.count(); c.maxRatio > 0 && c.read > c.minRatioBytes && float64(c.read) > c.maxRatio*float64(compressed) {
+		c.limitErr = &DecompressionLimitError{Compressed: compressed, Decompressed: c.read, Ratio: true}
+		return n, c.limitErr
+	}
+
+	return n, err
+}
+
+// exceeded returns the limit error, if the request body exceeded any limit
+func (c *compressedBodyReader) exceeded() error {
+	if c.limitErr == nil {
+		return nil
+	}
+
+	return c.limitErr
 }
 
 func (c *compressedBodyReader) Close() error {
@@ -27,3 +110,42 @@ func (c *compressedBodyReader) Close() error {
 	}
 	return nil
 }
+
+// limited returns true if any limit applies to the body
+func (c *compressedBodyReader) limited() bool {
+	return c.maxBytes > 0 || c.maxRatio > 0
+}
+
+// bodyLimitWriter responds with 413 Request Entity Too Large instead of the status chosen by the handler if the request
+// body exceeded the decompression limits before the headers were sent
+type bodyLimitWriter struct {
+	gin.ResponseWriter
+	body *compressedBodyReader
+}
+
+// checkLimits replaces the status if the headers are about to be sent
+func (w *bodyLimitWriter) checkLimits() {
+	if !w.ResponseWriter.Written() && w.body.exceeded() != nil {
+		w.ResponseWriter.WriteHeader(413)
+	}
+}
+
+func (w *bodyLimitWriter) Write(b []byte) (int, error) {
+	w.checkLimits()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *bodyLimitWriter) WriteString(s string) (int, error) {
+	w.checkLimits()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *bodyLimitWriter) WriteHeaderNow() {
+	w.checkLimits()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *bodyLimitWriter) Flush() {
+	w.checkLimits()
+	w.ResponseWriter.Flush()
+}
@@ -10,32 +10,70 @@ file, You can obtain one at https://mozilla.org/MPL/2.0/.
 
 import (
 	"bytes"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// sniffLen is the number of bytes considered by http.DetectContentType
+const sniffLen = 512
+
+// errClosed is returned when writing to an encoded response after the middleware has finished with it
+var errClosed = errors.New("write to an encoded response that has already been closed")
+
 // respWriter wraps the default request writer to allow for compressing the request contents. It uses an internal buffer
 // until threshold is hit, at which point it switches to the compressor.
 // If threshold is never hit, calling Close() will copy the buffer contents to the response writer
 type respWriter struct {
 	gin.ResponseWriter
-	threshold    int
-	encoding     string
-	algo         algorithm
-	buf          *bytes.Buffer
-	bytesWritten int
-	compressor   io.WriteCloser
+	cfg             *compressOptions
+	threshold       int
+	encoding        string
+	algo            Algorithm
+	candidates      []Candidate // the codings that cfg.chooser may choose from, most preferred first
+	identityAllowed bool
+	head            bool   // HEAD responses only need the headers that the equivalent GET would have
+	ifNoneMatch     string // the If-None-Match header sent by the client, before translateIfNoneMatch
+	buf             *bytes.Buffer
+	bytesWritten    int
+	compressor      io.WriteCloser
+	sink            *detachableWriter // receives the output of compressor
+	out             io.Writer         // receives the response body once swapped
+	err             error             // the first error encountered while writing the response
+	unencodedHeader http.Header       // the headers changed by swap, as the handler set them
+
+	// mu guards the writer, since event streams may be flushed by flushTimer
+	mu         sync.Mutex
+	closed     bool
+	eventTail  []byte      // the end of the last event stream write
+	flushTimer *time.Timer // pending flush of an event stream
+	eventFlush bool        // the response is an event stream that is flushed according to cfg.eventStreamFlush
+
+	decision    Decision // records how the response was handled
+	encodedSize int      // size of the encoded body if it was encoded in memory, otherwise -1
 }
 
-func newResponseWriter(c *gin.Context, swapSize int, encoding string, algo algorithm) *respWriter {
+// newResponseWriter creates a writer that encodes the response using the first candidate, unless cfg.chooser picks
+// another one
+func newResponseWriter(c *gin.Context, cfg *compressOptions, swapSize int, candidates []Candidate, identityAllowed bool) *respWriter {
 	return &respWriter{
-		c.Writer,
-		swapSize,
-		encoding,
-		algo,
-		bytes.NewBuffer(nil),
-		0,
-		nil,
+		ResponseWriter:  c.Writer,
+		cfg:             cfg,
+		threshold:       swapSize,
+		encoding:        candidates[0].Coding,
+		algo:            cfg.algorithms[candidates[0].Coding],
+		candidates:      candidates,
+		identityAllowed: identityAllowed,
+		head:            c.Request.Method == http.MethodHead,
+		ifNoneMatch:     strings.Join(c.Request.Header.Values("If-None-Match"), ","),
+		buf:             bytes.NewBuffer(nil),
+		encodedSize:     -1,
 	}
 }
 
@@ -44,29 +82,55 @@ func (rw *respWriter) WriteString(s string) (int, error) {
 }
 
 func (rw *respWriter) Write(b []byte) (int, error) {
-	rw.Header().Del("Content-Length")
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.closed && rw.compressor != nil {
+		// the compressor has been returned to its pool
+		return 0, errClosed
+	} else if rw.err != nil {
+		// the response is already incomplete
+		return 0, rw.err
+	}
 
-	if !rw.Swapped() && rw.buf.Len()+len(b) >= rw.threshold {
-		rw.ResponseWriter.Header().Set("Content-Encoding", rw.encoding)
-		rw.ResponseWriter.Header().Set("Vary", "Accept-Encoding")
-		rw.compressor = rw.algo.getWriter(rw.ResponseWriter)
-		if copied, err := io.Copy(rw.compressor, rw.buf); err != nil {
-			return int(copied), err
+	if !rw.Swapped() && !bodyAllowedForStatus(rw.Status()) {
+		// bodiless responses are never encoded, the underlying writer will reject the body if need be
+		if err := rw.skipSmall(nil); err != nil {
+			return 0, rw.fail(err)
+		}
+	}
+
+	if !rw.Swapped() {
+		declared := rw.declaredLength()
+
+		var err error
+		if rw.isEventStream() || (declared >= 0 && rw.overflows(declared)) || rw.overflows(int64(rw.buf.Len()+len(b))) {
+			err = rw.swap(b)
+		} else if declared >= 0 && declared < int64(rw.threshold) {
+			// the handler declared a length that is too small to compress, so there is no need to buffer the response
+			err = rw.skipSmall(b)
+		}
+
+		if err != nil {
+			return 0, rw.fail(err)
 		}
-		rw.buf = nil
 	}
 
 	var w io.Writer
 	if rw.Swapped() {
-		w = rw.compressor
+		w = rw.out
 	} else {
 		w = rw.buf
 	}
 
 	if n, err := w.Write(b); err != nil {
-		return n, err
+		rw.bytesWritten += n
+		return n, rw.fail(err)
 	} else {
 		rw.bytesWritten += n
+		if rw.eventFlush {
+			rw.afterEventStreamWrite(b)
+		}
 		return n, err
 	}
 }
@@ -75,28 +139,505 @@ func (rw *respWriter) Size() int {
 	return rw.bytesWritten
 }
 
+// Written returns true once the handler has written a body or the headers have been sent, as gin's writer would
 func (rw *respWriter) Written() bool {
-	return rw.bytesWritten > 0
+	return rw.bytesWritten > 0 || rw.ResponseWriter.Written()
 }
 
+// Close completes the response and returns the first error encountered while writing it
 func (rw *respWriter) Close() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.closed {
+		return rw.err
+	}
+
+	rw.closed = true
+	if rw.flushTimer != nil {
+		rw.flushTimer.Stop()
+	}
+
+	_ = rw.fail(rw.finish())
+	return rw.err
+}
+
+// abandon releases the compressor of a response that will not be completed, e.g. because the handler panicked.
+// Unlike Close, nothing more is sent to the client. It returns the first error encountered while writing the response.
+func (rw *respWriter) abandon() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.closed {
+		return rw.err
+	}
+
+	rw.closed = true
+	if rw.flushTimer != nil {
+		rw.flushTimer.Stop()
+	}
+
+	if rw.compressor != nil {
+		// closing returns the compressor to its pool, but its trailer would make the response look complete
+		rw.sink.detach()
+		_ = rw.compressor.Close()
+	}
+
+	if rw.unencodedHeader != nil && !rw.ResponseWriter.Written() {
+		// the encoder hasn't sent anything yet, so whatever the recovering middleware writes goes out unencoded
+		rw.restoreHeaders()
+	}
+
+	return rw.err
+}
+
+// finish writes whatever is left of the response. mu must be held.
+func (rw *respWriter) finish() error {
 	if !rw.Swapped() {
+		if rw.head && rw.buf.Len() == 0 && rw.declaredLength() >= int64(rw.threshold) && bodyAllowedForStatus(rw.Status()) {
+			// HEAD handlers such as http.ServeContent only declare the length of the body that GET would send
+			return rw.swap(nil)
+		}
+
+		if rw.buf.Len() > 0 && rw.buf.Len() >= rw.threshold && bodyAllowedForStatus(rw.Status()) {
+			// the whole response fit in the buffer, so it can be encoded with an accurate Content-Length
+			return rw.encodeBuffered()
+		}
+
 		// buf was never switched...
-		if _, err := io.Copy(rw.ResponseWriter, rw.buf); err != nil {
-			return err
+		if !rw.head || rw.buf.Len() > 0 {
+			rw.setContentLength(rw.buf.Len())
+		}
+		return rw.skipSmall(nil)
+	} else if rw.compressor != nil {
+		if rw.err != nil {
+			// an incomplete response must not end with a trailer that makes it look complete
+			rw.sink.detach()
 		}
-	} else {
 		return rw.compressor.Close()
 	}
 
 	return nil
 }
 
-func (rw *respWriter) Swapped() bool {
-	return rw.buf == nil
+// WriteHeaderNow sends the headers before any body has been written, so the encoding must be decided now.
+func (rw *respWriter) WriteHeaderNow() {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if !rw.Swapped() && rw.Status() >= 200 {
+		// errors are reported once the handler returns
+		if bodyAllowedForStatus(rw.Status()) && rw.declaredLength() >= int64(rw.threshold) {
+			_ = rw.fail(rw.swap(nil))
+		} else {
+			_ = rw.fail(rw.skipSmall(nil))
+		}
+	}
+
+	rw.ResponseWriter.WriteHeaderNow()
 }
 
-func (rw *respWriter) WriteHeader(code int) {
+// Flush sends everything written so far to the client. Since the response may continue indefinitely, flushing
+// commits to encoding the response regardless of threshold.
+func (rw *respWriter) Flush() {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if !rw.closed {
+		rw.flushLocked()
+	}
+}
+
+// flushLocked implements Flush. mu must be held.
+func (rw *respWriter) flushLocked() {
+	if rw.err != nil {
+		return
+	}
+
+	if !rw.Swapped() {
+		var err error
+		if bodyAllowedForStatus(rw.Status()) {
+			err = rw.swap(nil)
+		} else {
+			err = rw.skipSmall(nil)
+		}
+
+		if rw.fail(err) != nil {
+			return
+		}
+	}
+
+	if f, ok := rw.compressor.(flusher); ok {
+		if rw.fail(f.Flush()) != nil {
+			return
+		}
+	}
+
+	rw.ResponseWriter.Flush()
+}
+
+// swap is called once the response is large enough to compress. next is the chunk that is about to be written,
+// which is only used to inspect the response. Responses that shouldn't be compressed are written as-is from now on.
+func (rw *respWriter) swap(next []byte) error {
+	if reason := rw.skipReason(rw.buf.Bytes(), next); reason != "" {
+		rw.decision = reason
+		return rw.passthrough(false)
+	}
+	if !rw.choose(len(next)) {
+		rw.decision = DecisionChooser
+		return rw.passthrough(true)
+	}
+	if !rw.selectForSize(len(next)) {
+		rw.decision = DecisionTooLarge
+		return rw.passthrough(true)
+	}
+
+	rw.decision = DecisionEncoded
+	rw.saveHeaders()
 	rw.Header().Del("Content-Length")
-	rw.ResponseWriter.WriteHeader(code)
+	rw.setEncodedHeaders()
+
+	if rw.head {
+		// the body of a HEAD response is discarded anyway, so there is nothing to compress
+		rw.out = ioutil.Discard
+	} else {
+		rw.sink = &detachableWriter{w: rw.ResponseWriter}
+		rw.compressor = rw.algo.GetWriter(rw.sink)
+		rw.out = rw.compressor
+		rw.eventFlush = rw.isEventStream()
+	}
+
+	buffered := rw.buf
+	rw.buf = nil
+
+	_, err := io.Copy(rw.out, buffered)
+	return err
+}
+
+// encodeBuffered encodes the complete response in memory, so that Content-Length can be set. If encoding doesn't make
+// the response sufficiently smaller, it is sent unencoded instead.
+func (rw *respWriter) encodeBuffered() error {
+	if reason := rw.skipReason(rw.buf.Bytes(), nil); reason != "" {
+		rw.decision = reason
+		rw.setContentLength(rw.buf.Len())
+		return rw.passthrough(false)
+	}
+	if !rw.choose(0) {
+		rw.decision = DecisionChooser
+		rw.setContentLength(rw.buf.Len())
+		return rw.passthrough(true)
+	}
+	if !rw.selectForSize(0) {
+		rw.decision = DecisionTooLarge
+		rw.setContentLength(rw.buf.Len())
+		return rw.passthrough(true)
+	}
+
+	encoded := bytes.NewBuffer(nil)
+	compressor := rw.algo.GetWriter(encoded)
+	if _, err := compressor.Write(rw.buf.Bytes()); err != nil {
+		_ = compressor.Close()
+		return err
+	}
+	if err := compressor.Close(); err != nil {
+		return err
+	}
+
+	rw.encodedSize = encoded.Len()
+	if float64(encoded.Len()) >= rw.cfg.maxEncodedRatio*float64(rw.buf.Len()) {
+		// the representation still depended on Accept-Encoding, so Vary is set by passthrough
+		rw.decision = DecisionNotSmaller
+		rw.setContentLength(rw.buf.Len())
+		return rw.passthrough(true)
+	}
+
+	rw.decision = DecisionEncoded
+	rw.setEncodedHeaders()
+	rw.Header().Set("Content-Length", strconv.Itoa(encoded.Len()))
+
+	rw.buf = nil
+	if rw.head {
+		rw.out = ioutil.Discard
+		return nil
+	}
+
+	rw.out = rw.ResponseWriter
+	_, err := rw.out.Write(encoded.Bytes())
+	return err
+}
+
+// setEncodedHeaders updates the headers to describe the encoded representation
+func (rw *respWriter) setEncodedHeaders() {
+	rw.Header().Set("Content-Encoding", rw.encoding)
+	addVary(rw.Header(), "Accept-Encoding")
+	rw.setEncodedETag()
+
+	if rw.cfg.rangePolicy == RangeStripAcceptRanges {
+		// ranges of the encoded representation cannot be served
+		rw.Header().Del("Accept-Ranges")
+	}
+}
+
+// encodedHeaders lists the headers that swap changes when it starts encoding the response
+var encodedHeaders = []string{"Content-Encoding", "Content-Length", "Vary", "ETag", "Accept-Ranges"}
+
+// saveHeaders copies the headers in encodedHeaders, so that restoreHeaders can undo the changes made by swap
+func (rw *respWriter) saveHeaders() {
+	rw.unencodedHeader = make(http.Header, len(encodedHeaders))
+
+	for _, name := range encodedHeaders {
+		for _, value := range rw.Header().Values(name) {
+			rw.unencodedHeader.Add(name, value)
+		}
+	}
+}
+
+// restoreHeaders sets the headers in encodedHeaders back to what the handler set
+func (rw *respWriter) restoreHeaders() {
+	for _, name := range encodedHeaders {
+		rw.Header().Del(name)
+
+		for _, value := range rw.unencodedHeader.Values(name) {
+			rw.Header().Add(name, value)
+		}
+	}
+}
+
+// selectForSize switches to the cheaper algorithm configured by WithLargeCompressLevel if the response is larger than
+// WithMaxCompressBytes. It returns false if the response is too large to encode at all. next is the size of the chunk
+// that is about to be written.
+func (rw *respWriter) selectForSize(next int) bool {
+	if rw.cfg.maxCompressBytes <= 0 {
+		return true
+	}
+
+	if size, _ := rw.responseSize(next); size <= rw.cfg.maxCompressBytes {
+		return true
+	}
+
+	large, ok := rw.cfg.largeAlgorithms[rw.encoding]
+	if ok {
+		rw.algo = large
+	}
+
+	return ok
+}
+
+// responseSize returns the Content-Length set by the handler, or else the number of bytes written so far including
+// the next chunk. declared is true if the size is the Content-Length.
+func (rw *respWriter) responseSize(next int) (size int64, declared bool) {
+	if size = rw.declaredLength(); size >= 0 {
+		return size, true
+	}
+
+	return int64(rw.buf.Len() + next), false
+}
+
+// codings returns the codings that the response may be encoded with
+func (rw *respWriter) codings() []string {
+	if rw.cfg.chooser == nil {
+		return []string{rw.encoding}
+	}
+
+	codings := make([]string, len(rw.candidates))
+	for i, candidate := range rw.candidates {
+		codings[i] = candidate.Coding
+	}
+
+	return codings
+}
+
+// fail records err if it is the first error encountered while writing the response, and returns it
+func (rw *respWriter) fail(err error) error {
+	if err != nil && rw.err == nil {
+		rw.err = err
+	}
+
+	return err
+}
+
+// detachableWriter forwards writes to w until it is detached, after which they are discarded
+type detachableWriter struct {
+	w io.Writer
+}
+
+func (d *detachableWriter) Write(b []byte) (int, error) {
+	return d.w.Write(b)
+}
+
+// detach discards all further writes, so that a compressor can be closed without its output reaching the client
+func (d *detachableWriter) detach() {
+	d.w = ioutil.Discard
+}
+
+// overflows returns true if a response of size bytes is too large to keep buffering
+func (rw *respWriter) overflows(size int64) bool {
+	return size >= int64(rw.threshold) && (rw.cfg.bufferBytes <= 0 || size > int64(rw.cfg.bufferBytes))
+}
+
+// setContentLength sets Content-Length to the size of the complete response, unless the handler already declared it
+func (rw *respWriter) setContentLength(size int) {
+	if _, ok := rw.Header()["Content-Length"]; ok || !bodyAllowedForStatus(rw.Status()) {
+		return
+	}
+
+	rw.Header().Set("Content-Length", strconv.Itoa(size))
+}
+
+// skipSmall writes the response unencoded because it is too small or has no body. next is the chunk that is about to
+// be written, if any.
+func (rw *respWriter) skipSmall(next []byte) error {
+	if !bodyAllowedForStatus(rw.Status()) {
+		rw.decision = DecisionBodiless
+		return rw.passthrough(false)
+	}
+
+	reason := rw.skipReason(rw.buf.Bytes(), next)
+	if reason == "" {
+		reason = DecisionTooSmall
+	}
+
+	rw.decision = reason
+	return rw.passthrough(reason == DecisionTooSmall)
+}
+
+// passthrough writes the buffered response as-is, and the rest of the response will follow it unmodified.
+// negotiated should be true if the response is unencoded only because it is too small, as it still
+// depended on Accept-Encoding.
+func (rw *respWriter) passthrough(negotiated bool) error {
+	if rw.Status() == http.StatusNotModified || (negotiated && bodyAllowedForStatus(rw.Status())) {
+		// a 304 must carry the Vary header that the 200 would have, but not its Content-Encoding
+		addVary(rw.Header(), "Accept-Encoding")
+	}
+	if rw.Status() == http.StatusNotModified {
+		rw.revalidateETag()
+	}
+
+	buffered := rw.buf
+	rw.buf = nil
+	rw.out = rw.ResponseWriter
+
+	_, err := io.Copy(rw.out, buffered)
+	return err
+}
+
+// declaredLength returns the Content-Length set by the handler, or -1 if there isn't one
+func (rw *respWriter) declaredLength() int64 {
+	cl, err := strconv.ParseInt(rw.Header().Get("Content-Length"), 10, 64)
+	if err != nil || cl < 0 {
+		return -1
+	}
+
+	return cl
+}
+
+// bodyAllowedForStatus reports whether a response with the given status may have a body, see RFC 9110 section 6.4.1
+func bodyAllowedForStatus(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// skipReason returns why the response must not be encoded, or "" if it may be. buffered and next are used to sniff
+// the Content-Type if the handler didn't set one.
+func (rw *respWriter) skipReason(buffered []byte, next []byte) Decision {
+	if rw.Header().Get("Content-Encoding") != "" {
+		return DecisionHandlerEncoded
+	}
+	if hasCacheDirective(rw.Header(), "no-transform") {
+		return DecisionNoTransform
+	}
+	if rw.isPartial() {
+		return DecisionRange
+	}
+	if rw.cfg.statusFunc != nil && !rw.cfg.statusFunc(rw.Status()) {
+		return DecisionStatus
+	}
+
+	rw.sniffContentType(buffered, next)
+	if !rw.cfg.compressibleContentType(rw.Header().Get("Content-Type")) {
+		return DecisionContentType
+	}
+
+	return ""
+}
+
+// sniffContentType sets the Content-Type the same way net/http would, since it won't sniff encoded bodies
+func (rw *respWriter) sniffContentType(buffered []byte, next []byte) {
+	if _, ok := rw.Header()["Content-Type"]; ok {
+		return
+	}
+
+	if len(buffered) == 0 && len(next) == 0 {
+		// nothing to go on, e.g. a HEAD response
+		return
+	}
+
+	head := make([]byte, 0, sniffLen)
+	head = append(head, buffered[:minInt(len(buffered), sniffLen)]...)
+	head = append(head, next[:minInt(len(next), sniffLen-len(head))]...)
+
+	rw.Header().Set("Content-Type", http.DetectContentType(head))
+}
+
+// hasCacheDirective returns true if the Cache-Control header contains directive
+func hasCacheDirective(h http.Header, directive string) bool {
+	for _, value := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(value, ",") {
+			if i := strings.IndexByte(d, '='); i >= 0 {
+				d = d[:i]
+			}
+
+			if strings.EqualFold(trimOWS(d), directive) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// addVary adds token to the Vary header, keeping any tokens that were already there
+func addVary(h http.Header, token string) {
+	values := h.Values("Vary")
+
+	for _, value := range values {
+		for _, t := range strings.Split(value, ",") {
+			t = trimOWS(t)
+			if t == "*" || strings.EqualFold(t, token) {
+				return
+			}
+		}
+	}
+
+	if existing := strings.Join(values, ", "); existing != "" {
+		h.Set("Vary", existing+", "+token)
+	} else {
+		h.Set("Vary", token)
+	}
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// result describes how the response was handled, once the writer has been closed
+func (rw *respWriter) result() *EncodingResult {
+	res := &EncodingResult{
+		Decision:    rw.decision,
+		Size:        rw.bytesWritten,
+		EncodedSize: rw.encodedSize,
+		Err:         rw.err,
+	}
+	if rw.decision == DecisionEncoded {
+		res.Encoding = rw.encoding
+	}
+
+	return res
+}
+
+func (rw *respWriter) Swapped() bool {
+	return rw.buf == nil
 }
@@ -25,20 +25,20 @@ const (
 type algorithmBrotli struct {
 	compressorPool   *sync.Pool
 	decompressorPool *sync.Pool
-	cfg              algorithmConfig
+	cfg              AlgorithmConfig
 }
 
 func (a *algorithmBrotli) makeCompressor() interface{} {
-	return brotli.NewWriterLevel(ioutil.Discard, a.cfg.compressLevel)
+	return brotli.NewWriterLevel(ioutil.Discard, a.cfg.CompressLevel)
 }
 
-/* Implement algorithm */
+/* Implement Algorithm */
 
-func (a *algorithmBrotli) getConfig() *algorithmConfig {
+func (a *algorithmBrotli) GetConfig() *AlgorithmConfig {
 	return &a.cfg
 }
 
-func (a *algorithmBrotli) getWriter(w io.Writer) io.WriteCloser {
+func (a *algorithmBrotli) GetWriter(w io.Writer) io.WriteCloser {
 	bw := a.compressorPool.Get().(*brotli.Writer)
 	bw.Reset(w)
 
@@ -48,24 +48,34 @@ func (a *algorithmBrotli) getWriter(w io.Writer) io.WriteCloser {
 	}
 }
 
-func (a *algorithmBrotli) getReader(r io.Reader) io.ReadCloser {
+func (a *algorithmBrotli) GetReader(r io.Reader) (io.ReadCloser, error) {
 	br := a.decompressorPool.Get().(*brotli.Reader)
 	if err := br.Reset(r); err != nil {
-		panic(err)
+		a.decompressorPool.Put(br)
+		return nil, err
 	}
 
 	return &wrappedReader{
 		p: a.decompressorPool,
 		r: br,
-	}
+	}, nil
+}
+
+// WithLevel returns a new brotli algorithm with the same configuration and its own pools, which uses level
+func (a *algorithmBrotli) WithLevel(level int) Algorithm {
+	b := newAlgorithmBrotli()
+	b.cfg = a.cfg
+	b.cfg.CompressLevel = level
+
+	return b
 }
 
 func newAlgorithmBrotli() *algorithmBrotli {
 	a := algorithmBrotli{
-		cfg: algorithmConfig{
-			priority:      400,
-			enable:        true,
-			compressLevel: BrotliDefaultCompression,
+		cfg: AlgorithmConfig{
+			Priority:      400,
+			Enable:        true,
+			CompressLevel: BrotliDefaultCompression,
 		},
 		decompressorPool: &sync.Pool{
 			New: func() interface{} {
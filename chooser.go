@@ -0,0 +1,123 @@
+package compress
+
+/*
+gin-compress Copyright (C) 2022 Aurora McGinnis
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+
+import (
+	"strings"
+	"sync"
+)
+
+// Candidate is an enabled algorithm that the client accepts
+type Candidate struct {
+	// Coding is the content coding of the algorithm
+	Coding string
+	// Q is the q-value that the client assigned to the coding, in thousandths
+	Q int
+	// Priority is the priority of the algorithm, see WithPriority
+	Priority int
+}
+
+// ResponseInfo describes the response that an AlgorithmChooser selects a coding for
+type ResponseInfo struct {
+	// Candidates lists the codings that may be used, in the order the middleware would prefer them
+	Candidates []Candidate
+	// IdentityAllowed is false if the client forbade unencoded responses
+	IdentityAllowed bool
+	// ContentType is the Content-Type of the response, which may have been sniffed
+	ContentType string
+	// Status is the status code of the response
+	Status int
+	// Size is the Content-Length set by the handler if SizeDeclared is true, otherwise the number of bytes written
+	// so far. Responses that are still being written may be larger.
+	Size         int64
+	SizeDeclared bool
+}
+
+// Choice is the coding selected by an AlgorithmChooser
+type Choice struct {
+	// Coding is one of the candidates, or "" to send the response unencoded
+	Coding string
+	// Level is used instead of the compression level configured for Coding if SetLevel is true. Level is ignored
+	// if the algorithm of Coding doesn't implement Leveler.
+	Level    int
+	SetLevel bool
+}
+
+// AlgorithmChooser selects the coding of a response once it is large enough to compress. Choices that name a coding
+// which isn't a candidate, or leave the response unencoded when identity is not allowed, are ignored.
+type AlgorithmChooser func(info *ResponseInfo) Choice
+
+// leveledAlgorithms holds the instances of algorithms used when a Choice overrides the level, as each level needs its
+// own pools
+type leveledAlgorithms struct {
+	mu    sync.Mutex
+	algos map[leveledAlgorithm]Algorithm
+}
+
+type leveledAlgorithm struct {
+	coding string
+	level  int
+}
+
+// get returns an instance of algo, the middleware's algorithm for coding, that uses level, or nil if algo doesn't
+// implement Leveler
+func (la *leveledAlgorithms) get(algo Algorithm, coding string, level int) Algorithm {
+	key := leveledAlgorithm{coding: coding, level: level}
+
+	la.mu.Lock()
+	defer la.mu.Unlock()
+
+	if leveled, ok := la.algos[key]; ok {
+		return leveled
+	}
+
+	leveled := withLevel(algo, level)
+	la.algos[key] = leveled
+
+	return leveled
+}
+
+// choose lets cfg.chooser select the coding of the response. It returns false if the response should be sent
+// unencoded. next is the size of the chunk that is about to be written.
+func (rw *respWriter) choose(next int) bool {
+	if rw.cfg.chooser == nil {
+		return true
+	}
+
+	size, declared := rw.responseSize(next)
+	choice := rw.cfg.chooser(&ResponseInfo{
+		Candidates:      rw.candidates,
+		IdentityAllowed: rw.identityAllowed,
+		ContentType:     rw.Header().Get("Content-Type"),
+		Status:          rw.Status(),
+		Size:            size,
+		SizeDeclared:    declared,
+	})
+
+	if choice.Coding == "" && rw.identityAllowed {
+		return false
+	}
+
+	for _, candidate := range rw.candidates {
+		if candidate.Coding != strings.ToLower(choice.Coding) {
+			continue
+		}
+
+		rw.encoding = candidate.Coding
+		rw.algo = rw.cfg.algorithms[candidate.Coding]
+		if choice.SetLevel {
+			if algo := rw.cfg.leveledAlgorithms.get(rw.algo, candidate.Coding, choice.Level); algo != nil {
+				rw.algo = algo
+			}
+		}
+		break
+	}
+
+	return true
+}
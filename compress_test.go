@@ -2,15 +2,22 @@ package compress_test
 
 import (
 	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
 	"github.com/andybalholm/brotli"
 	"github.com/klauspost/compress/gzip"
 	"github.com/klauspost/compress/zlib"
 	"github.com/klauspost/compress/zstd"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aurowora/compress"
 	"github.com/gin-gonic/gin"
@@ -38,6 +45,25 @@ func setupRouter(opts ...compress.CompressOption) *gin.Engine {
 	r.GET("/large", func(c *gin.Context) {
 		c.String(200, largeBody)
 	})
+	r.GET("/typed", func(c *gin.Context) {
+		c.Data(200, c.Query("type"), []byte(largeBody))
+	})
+	r.GET("/untyped", func(c *gin.Context) {
+		_, _ = c.Writer.Write([]byte("<html><body>" + largeBody + "</body></html>"))
+	})
+	r.GET("/precompressed", func(c *gin.Context) {
+		b := bytes.NewBuffer(nil)
+		gz := gzip.NewWriter(b)
+		_, _ = gz.Write([]byte(largeBody))
+		_ = gz.Close()
+
+		c.Header("Content-Encoding", "gzip")
+		c.Data(200, "text/plain", b.Bytes())
+	})
+	r.GET("/notransform", func(c *gin.Context) {
+		c.Header("Cache-Control", "private, No-Transform")
+		c.String(200, largeBody)
+	})
 	r.POST("/echo", func(c *gin.Context) {
 		c.Header("X-Request-Content-Encoding", c.GetHeader("Content-Encoding"))
 
@@ -48,6 +74,14 @@ func setupRouter(opts ...compress.CompressOption) *gin.Engine {
 
 		c.Data(200, "text/plain", b.Bytes())
 	})
+	r.POST("/drain", func(c *gin.Context) {
+		if _, err := io.Copy(ioutil.Discard, c.Request.Body); err != nil {
+			_ = c.Error(err)
+			return
+		}
+
+		c.Status(204)
+	})
 
 	return r
 }
@@ -72,7 +106,10 @@ func TestCompressNoopSmall(t *testing.T) {
 	w := httptest.NewRecorder()
 	r.ServeHTTP(w, req)
 
-	checkNoop(t, w)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	// the response still depended on Accept-Encoding
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
 
 	assert.Equal(t, w.Body.String(), smallBody)
 }
@@ -206,3 +243,1350 @@ func TestQ(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, b.String(), largeBody)
 }
+
+func TestIndependentInstances(t *testing.T) {
+	zstdOnly := setupRouter(
+		compress.WithAlgo(compress.GZIP, false),
+		compress.WithAlgo(compress.BROTLI, false),
+		compress.WithAlgo(compress.DEFLATE, false),
+	)
+	r := setupRouter(compress.WithCompressLevel(compress.BROTLI, compress.BrotliBestCompression))
+
+	req, _ := http.NewRequest("GET", "/large", nil)
+	req.Header.Add("Accept-Encoding", "gzip, zstd, br")
+
+	w := httptest.NewRecorder()
+	zstdOnly.ServeHTTP(w, req)
+	checkCompress(t, w, "zstd")
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	checkCompress(t, w, "br")
+
+	b := bytes.NewBuffer(nil)
+	if _, err := io.Copy(b, brotli.NewReader(w.Body)); err != nil {
+		t.Errorf("Decompression failed: %v\n", err)
+	}
+
+	assert.Equal(t, largeBody, b.String())
+}
+
+func TestStrictNegotiation(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/large", nil)
+	req.Header.Set("Accept-Encoding", "br, identity;q=0")
+
+	// without strict mode the body is sent unencoded
+	r := setupRouter(compress.WithAlgo(compress.BROTLI, false))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	checkNoop(t, w)
+
+	r = setupRouter(compress.WithAlgo(compress.BROTLI, false), compress.WithStrictNegotiation(true))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 406, w.Code)
+	assert.Equal(t, "", w.Body.String())
+
+	r = setupRouter(
+		compress.WithAlgo(compress.BROTLI, false),
+		compress.WithStrictNegotiation(true),
+		compress.WithNotAcceptableHandler(func(c *gin.Context) {
+			c.String(406, "gzip only")
+		}),
+	)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 406, w.Code)
+	assert.Equal(t, "gzip only", w.Body.String())
+}
+
+func TestStrictNegotiationSmall(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/small", nil)
+	req.Header.Set("Accept-Encoding", "gzip, *;q=0")
+	r := setupRouter(compress.WithStrictNegotiation(true))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	checkCompress(t, w, "gzip")
+
+	gz, err := gzip.NewReader(w.Body)
+	assert.NoError(t, err)
+	defer gz.Close()
+
+	b := bytes.NewBuffer(nil)
+	_, err = gz.WriteTo(b)
+	assert.NoError(t, err)
+	assert.Equal(t, smallBody, b.String())
+}
+
+func TestContentTypes(t *testing.T) {
+	cases := []struct {
+		opts        []compress.CompressOption
+		contentType string
+		expected    string
+	}{
+		{nil, "text/plain; charset=utf-8", "gzip"},
+		{nil, "image/png", ""},
+		{nil, "Video/MP4", ""},
+		{nil, "image/svg+xml", "gzip"},
+		{[]compress.CompressOption{compress.WithIncludeContentTypes("text/*", "application/*+json")}, "text/css", "gzip"},
+		{[]compress.CompressOption{compress.WithIncludeContentTypes("text/*", "application/*+json")}, "application/vnd.api+json", "gzip"},
+		{[]compress.CompressOption{compress.WithIncludeContentTypes("text/*", "application/*+json")}, "application/json", ""},
+		{[]compress.CompressOption{compress.WithExcludeContentTypes("text/csv")}, "text/csv", ""},
+		{[]compress.CompressOption{compress.WithExcludeContentTypes("text/csv")}, "image/png", "gzip"},
+	}
+
+	for _, tc := range cases {
+		r := setupRouter(tc.opts...)
+
+		req, _ := http.NewRequest("GET", "/typed?type="+url.QueryEscape(tc.contentType), nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, tc.expected, w.Header().Get("Content-Encoding"), tc.contentType)
+		if tc.expected == "" {
+			assert.Equal(t, largeBody, w.Body.String())
+		}
+	}
+}
+
+func TestSniffContentType(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/untyped", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	r := setupRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	checkCompress(t, w, "gzip")
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+}
+
+func TestNoDoubleEncoding(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/precompressed", nil)
+	req.Header.Set("Accept-Encoding", "br, gzip")
+	r := setupRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+
+	gz, err := gzip.NewReader(w.Body)
+	assert.NoError(t, err)
+	defer gz.Close()
+
+	b := bytes.NewBuffer(nil)
+	_, err = gz.WriteTo(b)
+	assert.NoError(t, err)
+	assert.Equal(t, largeBody, b.String())
+}
+
+func TestResponseNoTransform(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/notransform", nil)
+	req.Header.Set("Accept-Encoding", "br, gzip")
+	r := setupRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, largeBody, w.Body.String())
+}
+
+func TestRequestNoTransform(t *testing.T) {
+	var result *compress.EncodingResult
+	r := setupResultRouter(&result)
+
+	req, _ := http.NewRequest("GET", "/large", nil)
+	req.Header.Set("Accept-Encoding", "br, gzip")
+	req.Header.Set("Cache-Control", "no-cache, no-transform")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, largeBody, w.Body.String())
+	if assert.NotNil(t, result) {
+		assert.Equal(t, compress.DecisionNoTransform, result.Decision)
+	}
+}
+
+func setupStatusRouter(opts ...compress.CompressOption) *gin.Engine {
+	r := gin.New()
+	r.Use(compress.Compress(opts...))
+
+	serve := func(c *gin.Context) {
+		http.ServeContent(c.Writer, c.Request, "large.txt", time.Time{}, strings.NewReader(largeBody))
+	}
+	r.GET("/serve", serve)
+	r.HEAD("/serve", serve)
+
+	write := func(c *gin.Context) {
+		c.String(200, largeBody)
+	}
+	r.GET("/write", write)
+	r.HEAD("/write", write)
+
+	r.GET("/nocontent", func(c *gin.Context) {
+		c.Status(204)
+	})
+	r.GET("/notmodified", func(c *gin.Context) {
+		c.Header("ETag", `"abc"`)
+		c.String(304, "")
+	})
+
+	return r
+}
+
+func TestHead(t *testing.T) {
+	r := setupStatusRouter()
+
+	for _, path := range []string{"/serve", "/write"} {
+		get, _ := http.NewRequest("GET", path, nil)
+		get.Header.Set("Accept-Encoding", "gzip")
+		gw := httptest.NewRecorder()
+		r.ServeHTTP(gw, get)
+
+		head, _ := http.NewRequest("HEAD", path, nil)
+		head.Header.Set("Accept-Encoding", "gzip")
+		hw := httptest.NewRecorder()
+		r.ServeHTTP(hw, head)
+
+		checkCompress(t, gw, "gzip")
+		checkCompress(t, hw, "gzip")
+		assert.Equal(t, gw.Header().Get("Content-Length"), hw.Header().Get("Content-Length"), path)
+		assert.Equal(t, gw.Header().Get("Content-Type"), hw.Header().Get("Content-Type"), path)
+		assert.Equal(t, 0, hw.Body.Len(), path)
+	}
+}
+
+func TestHeadSmall(t *testing.T) {
+	r := setupStatusRouter(compress.WithMinCompressBytes(len(largeBody) + 1))
+
+	req, _ := http.NewRequest("HEAD", "/serve", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, strconv.Itoa(len(largeBody)), w.Header().Get("Content-Length"))
+}
+
+func TestBodilessStatus(t *testing.T) {
+	r := setupStatusRouter(compress.WithMinCompressBytes(0))
+
+	req, _ := http.NewRequest("GET", "/nocontent", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 204, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, 0, w.Body.Len())
+
+	req, _ = http.NewRequest("GET", "/notmodified", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 304, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Equal(t, 0, w.Body.Len())
+}
+
+func TestFlush(t *testing.T) {
+	for _, algo := range []string{compress.GZIP, compress.DEFLATE, compress.ZSTD, compress.BROTLI} {
+		w := httptest.NewRecorder()
+
+		r := gin.New()
+		r.Use(compress.Compress())
+		r.GET("/stream", func(c *gin.Context) {
+			c.Header("Content-Type", "text/plain")
+
+			for i := 0; i < 3; i++ {
+				chunk := fmt.Sprintf("chunk %d;", i)
+				_, _ = c.Writer.WriteString(chunk)
+				c.Writer.Flush()
+
+				// everything written so far must be decodable before the stream ends
+				assert.Equal(t, algo, w.Header().Get("Content-Encoding"))
+				assert.True(t, w.Flushed)
+			}
+		})
+
+		req, _ := http.NewRequest("GET", "/stream", nil)
+		req.Header.Set("Accept-Encoding", algo)
+		r.ServeHTTP(w, req)
+
+		checkCompress(t, w, algo)
+		assert.Equal(t, "chunk 0;chunk 1;chunk 2;", decode(t, algo, w.Body.Bytes()))
+	}
+}
+
+func TestFlushPartial(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	r := gin.New()
+	r.Use(compress.Compress())
+	r.GET("/stream", func(c *gin.Context) {
+		_, _ = c.Writer.WriteString(smallBody)
+		c.Writer.Flush()
+
+		gz, err := gzip.NewReader(bytes.NewReader(w.Body.Bytes()))
+		if assert.NoError(t, err) {
+			b := make([]byte, len(smallBody))
+			_, err = io.ReadFull(gz, b)
+			assert.NoError(t, err)
+			assert.Equal(t, smallBody, string(b))
+		}
+	})
+
+	req, _ := http.NewRequest("GET", "/stream", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	r.ServeHTTP(w, req)
+
+	checkCompress(t, w, "gzip")
+}
+
+// decode reverses the given content coding
+func decode(t *testing.T, algo string, body []byte) string {
+	var r io.Reader
+	var err error
+
+	switch algo {
+	case compress.GZIP:
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case compress.DEFLATE:
+		r, err = zlib.NewReader(bytes.NewReader(body))
+	case compress.ZSTD:
+		r, err = zstd.NewReader(bytes.NewReader(body))
+	case compress.BROTLI:
+		r = brotli.NewReader(bytes.NewReader(body))
+	default:
+		r = bytes.NewReader(body)
+	}
+	if !assert.NoError(t, err) {
+		return ""
+	}
+
+	b := bytes.NewBuffer(nil)
+	_, err = io.Copy(b, r)
+	assert.NoError(t, err)
+
+	return b.String()
+}
+
+// decodePartial decodes as much of an unfinished gzip stream as possible
+func decodePartial(body []byte) string {
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	b := bytes.NewBuffer(nil)
+	_, _ = io.Copy(b, gz)
+	return b.String()
+}
+
+func TestEventStreamSkipped(t *testing.T) {
+	r := gin.New()
+	r.Use(compress.Compress())
+	r.GET("/events", func(c *gin.Context) {
+		c.SSEvent("message", largeBody)
+	})
+
+	req, _ := http.NewRequest("GET", "/events", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	checkNoop(t, w)
+}
+
+func TestEventStreamFlushPolicies(t *testing.T) {
+	for _, policy := range []compress.EventStreamFlush{compress.FlushOnWrite, compress.FlushOnEvent, compress.FlushOnInterval} {
+		w := httptest.NewRecorder()
+
+		r := gin.New()
+		r.Use(compress.Compress(
+			compress.WithEventStreams(policy),
+			compress.WithEventStreamFlushInterval(10*time.Millisecond),
+		))
+		r.GET("/events", func(c *gin.Context) {
+			for i := 0; i < 3; i++ {
+				c.SSEvent("message", i)
+
+				if policy == compress.FlushOnInterval {
+					time.Sleep(50 * time.Millisecond)
+					// synchronizes with the flush timer
+					c.Writer.WriteHeaderNow()
+				}
+
+				assert.Contains(t, decodePartial(w.Body.Bytes()), fmt.Sprintf("data:%d\n\n", i))
+			}
+		})
+
+		req, _ := http.NewRequest("GET", "/events", nil)
+		req.Header.Set("Accept", "text/event-stream")
+		req.Header.Set("Accept-Encoding", "gzip")
+		r.ServeHTTP(w, req)
+
+		checkCompress(t, w, "gzip")
+		assert.Equal(t, "event:message\ndata:0\n\nevent:message\ndata:1\n\nevent:message\ndata:2\n\n", decode(t, "gzip", w.Body.Bytes()))
+	}
+}
+
+func TestVaryMerge(t *testing.T) {
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Header("Vary", "Origin")
+		c.Writer.Header().Add("Vary", "Authorization")
+	})
+	r.Use(compress.Compress())
+	r.GET("/large", func(c *gin.Context) {
+		c.String(200, largeBody)
+	})
+	r.GET("/small", func(c *gin.Context) {
+		c.String(200, smallBody)
+	})
+	r.GET("/wildcard", func(c *gin.Context) {
+		c.Header("Vary", "*")
+		c.String(200, largeBody)
+	})
+	r.GET("/duplicate", func(c *gin.Context) {
+		c.Header("Vary", "accept-encoding, Origin")
+		c.String(200, largeBody)
+	})
+
+	cases := map[string]string{
+		"/large":     "Origin, Authorization, Accept-Encoding",
+		"/small":     "Origin, Authorization, Accept-Encoding",
+		"/wildcard":  "*",
+		"/duplicate": "accept-encoding, Origin",
+	}
+
+	for path, expected := range cases {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, expected, strings.Join(w.Header().Values("Vary"), ", "), path)
+	}
+}
+
+func TestContentLengthSmall(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/small", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	r := setupRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, strconv.Itoa(len(smallBody)), w.Header().Get("Content-Length"))
+}
+
+func TestBufferedCompression(t *testing.T) {
+	r := setupRouter(compress.WithBufferedCompression(len(largeBody)))
+
+	req, _ := http.NewRequest("GET", "/large", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	checkCompress(t, w, "gzip")
+	assert.Equal(t, strconv.Itoa(w.Body.Len()), w.Header().Get("Content-Length"))
+	assert.Equal(t, largeBody, decode(t, "gzip", w.Body.Bytes()))
+
+	// too large to buffer
+	r = setupRouter(compress.WithBufferedCompression(len(largeBody) - 1))
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	checkCompress(t, w, "gzip")
+	assert.Equal(t, "", w.Header().Get("Content-Length"))
+	assert.Equal(t, largeBody, decode(t, "gzip", w.Body.Bytes()))
+}
+
+func setupResultRouter(result **compress.EncodingResult, opts ...compress.CompressOption) *gin.Engine {
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Next()
+
+		if v, ok := c.Get(compress.ResultKey); ok {
+			*result = v.(*compress.EncodingResult)
+		}
+	})
+	r.Use(compress.Compress(opts...))
+
+	random := make([]byte, 4096)
+	_, _ = rand.Read(random)
+
+	r.GET("/random", func(c *gin.Context) {
+		c.Data(200, "application/octet-stream", random)
+	})
+	r.GET("/large", func(c *gin.Context) {
+		c.String(200, largeBody)
+	})
+	r.GET("/small", func(c *gin.Context) {
+		c.String(200, smallBody)
+	})
+
+	return r
+}
+
+func TestSkipIncompressible(t *testing.T) {
+	var result *compress.EncodingResult
+	r := setupResultRouter(&result, compress.WithBufferedCompression(64*1024))
+
+	req, _ := http.NewRequest("GET", "/random", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Equal(t, "4096", w.Header().Get("Content-Length"))
+	assert.Equal(t, 4096, w.Body.Len())
+	if assert.NotNil(t, result) {
+		assert.Equal(t, compress.DecisionNotSmaller, result.Decision)
+		assert.Equal(t, "", result.Encoding)
+		assert.Equal(t, 4096, result.Size)
+		assert.Greater(t, result.EncodedSize, 4096)
+	}
+
+	req, _ = http.NewRequest("GET", "/large", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	checkCompress(t, w, "gzip")
+	if assert.NotNil(t, result) {
+		assert.Equal(t, compress.DecisionEncoded, result.Decision)
+		assert.Equal(t, "gzip", result.Encoding)
+		assert.Equal(t, len(largeBody), result.Size)
+		assert.Equal(t, w.Body.Len(), result.EncodedSize)
+	}
+}
+
+func TestMaxEncodedRatio(t *testing.T) {
+	var result *compress.EncodingResult
+	r := setupResultRouter(&result, compress.WithBufferedCompression(64*1024), compress.WithMaxEncodedRatio(0.01))
+
+	req, _ := http.NewRequest("GET", "/large", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, largeBody, w.Body.String())
+	if assert.NotNil(t, result) {
+		assert.Equal(t, compress.DecisionNotSmaller, result.Decision)
+	}
+
+	assert.Panics(t, func() {
+		compress.WithMaxEncodedRatio(0)
+	})
+	assert.Panics(t, func() {
+		compress.WithMaxEncodedRatio(-1)
+	})
+}
+
+func TestResults(t *testing.T) {
+	var result *compress.EncodingResult
+	r := setupResultRouter(&result)
+
+	cases := []struct {
+		path           string
+		acceptEncoding string
+		decision       compress.Decision
+	}{
+		{"/large", "gzip", compress.DecisionEncoded},
+		{"/small", "gzip", compress.DecisionTooSmall},
+		{"/random", "gzip", compress.DecisionEncoded},
+		{"/large", "", compress.DecisionNotAccepted},
+	}
+
+	for _, tc := range cases {
+		result = nil
+
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+
+		if assert.NotNil(t, result, tc.path) {
+			assert.Equal(t, tc.decision, result.Decision, tc.path)
+			assert.Equal(t, -1, result.EncodedSize, tc.path)
+		}
+	}
+}
+
+func TestRangeSkip(t *testing.T) {
+	r := setupStatusRouter()
+
+	req, _ := http.NewRequest("GET", "/serve", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=0-999")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 206, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "bytes 0-999/"+strconv.Itoa(len(largeBody)), w.Header().Get("Content-Range"))
+	assert.Equal(t, largeBody[:1000], w.Body.String())
+
+	req, _ = http.NewRequest("GET", "/serve", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	checkCompress(t, w, "gzip")
+	assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+}
+
+func TestRangeStripAcceptRanges(t *testing.T) {
+	r := setupStatusRouter(compress.WithRangePolicy(compress.RangeStripAcceptRanges))
+
+	req, _ := http.NewRequest("GET", "/serve", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	checkCompress(t, w, "gzip")
+	assert.Equal(t, "", w.Header().Get("Accept-Ranges"))
+	assert.Equal(t, largeBody, decode(t, "gzip", w.Body.Bytes()))
+
+	// partial responses are never encoded
+	for _, rng := range []string{"bytes=0-99", "bytes=0-999"} {
+		req, _ = http.NewRequest("GET", "/serve", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Set("Range", rng)
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, 206, w.Code, rng)
+		assert.Equal(t, "", w.Header().Get("Content-Encoding"), rng)
+		assert.NotEmpty(t, w.Header().Get("Content-Range"), rng)
+	}
+
+	// the handler ignores the range if If-Range doesn't match, so the full response can be encoded
+	req, _ = http.NewRequest("GET", "/serve", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=0-99")
+	req.Header.Set("If-Range", `"stale"`)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	checkCompress(t, w, "gzip")
+	assert.Equal(t, largeBody, decode(t, "gzip", w.Body.Bytes()))
+}
+
+func setupETagRouter(opts ...compress.CompressOption) *gin.Engine {
+	r := gin.New()
+	r.Use(compress.Compress(opts...))
+
+	r.GET("/etag", func(c *gin.Context) {
+		c.Header("X-If-None-Match", c.GetHeader("If-None-Match"))
+		c.Header("ETag", `"v1"`)
+
+		if c.GetHeader("If-None-Match") == `"v1"` {
+			c.Status(304)
+			return
+		}
+		c.String(200, largeBody)
+	})
+	r.GET("/serve", func(c *gin.Context) {
+		c.Header("ETag", `"v1"`)
+		http.ServeContent(c.Writer, c.Request, "large.txt", time.Time{}, strings.NewReader(largeBody))
+	})
+
+	return r
+}
+
+func TestETagSuffix(t *testing.T) {
+	r := setupETagRouter()
+
+	req, _ := http.NewRequest("GET", "/etag", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	checkCompress(t, w, "gzip")
+	assert.Equal(t, `"v1-gzip"`, w.Header().Get("ETag"))
+
+	// the handler sees its own ETag, and the 304 identifies the encoded representation
+	req.Header.Set("If-None-Match", `"v1-gzip"`)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 304, w.Code)
+	assert.Equal(t, `"v1"`, w.Header().Get("X-If-None-Match"))
+	assert.Equal(t, `"v1-gzip"`, w.Header().Get("ETag"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+
+	// an unencoded representation cached by the client is revalidated as-is
+	req.Header.Set("If-None-Match", `"v1"`)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 304, w.Code)
+	assert.Equal(t, `"v1"`, w.Header().Get("ETag"))
+
+	// other codings and entity tags containing commas are left alone
+	req.Header.Set("If-None-Match", `"a,b", W/"v1-gzip", "v1-br", "v1-gzip"`)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	checkCompress(t, w, "gzip")
+	assert.Equal(t, `"a,b", W/"v1-gzip", "v1-br", "v1"`, w.Header().Get("X-If-None-Match"))
+
+	// http.ServeContent uses the weak comparison, which also matches the translated ETag
+	req, _ = http.NewRequest("GET", "/serve", nil)
+	req.Header.Set("Accept-Encoding", "br")
+	req.Header.Set("If-None-Match", `"v1-br"`)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 304, w.Code)
+	assert.Equal(t, `"v1-br"`, w.Header().Get("ETag"))
+}
+
+func TestETagWeaken(t *testing.T) {
+	r := setupETagRouter(compress.WithETagPolicy(compress.ETagWeaken))
+
+	req, _ := http.NewRequest("GET", "/serve", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	checkCompress(t, w, "gzip")
+	assert.Equal(t, `W/"v1"`, w.Header().Get("ETag"))
+
+	req.Header.Set("If-None-Match", `W/"v1"`)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 304, w.Code)
+	assert.Equal(t, `W/"v1"`, w.Header().Get("ETag"))
+}
+
+func TestETagKeep(t *testing.T) {
+	r := setupETagRouter(compress.WithETagPolicy(compress.ETagKeep))
+
+	req, _ := http.NewRequest("GET", "/etag", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	checkCompress(t, w, "gzip")
+	assert.Equal(t, `"v1"`, w.Header().Get("ETag"))
+}
+
+func TestStatusFilter(t *testing.T) {
+	var result *compress.EncodingResult
+
+	for _, opt := range []compress.CompressOption{
+		compress.WithStatusCodes(200, 201),
+		compress.WithStatusFunc(func(status int) bool { return status < 300 }),
+	} {
+		r := setupResultRouter(&result, opt)
+		r.GET("/error", func(c *gin.Context) {
+			c.String(500, largeBody)
+		})
+
+		req, _ := http.NewRequest("GET", "/error", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, 500, w.Code)
+		assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+		assert.Equal(t, largeBody, w.Body.String())
+		if assert.NotNil(t, result) {
+			assert.Equal(t, compress.DecisionStatus, result.Decision)
+		}
+
+		req, _ = http.NewRequest("GET", "/large", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		checkCompress(t, w, "gzip")
+	}
+}
+
+func TestMaxCompressBytes(t *testing.T) {
+	var result *compress.EncodingResult
+	r := setupResultRouter(&result, compress.WithMaxCompressBytes(int64(len(largeBody)-1)))
+	r.GET("/serve", func(c *gin.Context) {
+		http.ServeContent(c.Writer, c.Request, "large.txt", time.Time{}, strings.NewReader(largeBody))
+	})
+
+	for _, path := range []string{"/large", "/serve"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code, path)
+		assert.Equal(t, "", w.Header().Get("Content-Encoding"), path)
+		assert.Equal(t, largeBody, w.Body.String(), path)
+		if assert.NotNil(t, result, path) {
+			assert.Equal(t, compress.DecisionTooLarge, result.Decision, path)
+		}
+	}
+}
+
+func TestLargeCompressLevel(t *testing.T) {
+	var result *compress.EncodingResult
+	r := setupResultRouter(&result,
+		compress.WithMaxCompressBytes(int64(len(largeBody)-1)),
+		compress.WithLargeCompressLevel(compress.GZIP, compress.GzFlateNoCompression))
+
+	req, _ := http.NewRequest("GET", "/large", nil)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	// brotli is preferred but has no cheaper level, so the response is sent unencoded
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	if assert.NotNil(t, result) {
+		assert.Equal(t, compress.DecisionTooLarge, result.Decision)
+	}
+
+	req.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	checkCompress(t, w, "gzip")
+	assert.Greater(t, w.Body.Len(), len(largeBody))
+	assert.Equal(t, largeBody, decode(t, "gzip", w.Body.Bytes()))
+	if assert.NotNil(t, result) {
+		assert.Equal(t, compress.DecisionEncoded, result.Decision)
+	}
+}
+
+// levelAlgo is an algorithm that writes its name and compression level, followed by its input as-is
+type levelAlgo struct {
+	name string
+	cfg  compress.AlgorithmConfig
+}
+
+type levelWriter struct {
+	io.Writer
+}
+
+func (levelWriter) Close() error {
+	return nil
+}
+
+func (a *levelAlgo) GetWriter(w io.Writer) io.WriteCloser {
+	_, _ = fmt.Fprintf(w, "%s%d:", a.name, a.cfg.CompressLevel)
+	return levelWriter{w}
+}
+
+func (a *levelAlgo) GetReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+func (a *levelAlgo) GetConfig() *compress.AlgorithmConfig {
+	return &a.cfg
+}
+
+func (a *levelAlgo) WithLevel(level int) compress.Algorithm {
+	l := &levelAlgo{name: a.name, cfg: a.cfg}
+	l.cfg.CompressLevel = level
+	return l
+}
+
+func TestLargeCompressLevelPerMiddleware(t *testing.T) {
+	large := compress.WithLargeCompressLevel("x-level", 9)
+
+	for _, name := range []string{"a", "b"} {
+		// the same option value is used by both middlewares, but each gets a copy of its own algorithm
+		r := setupRouter(
+			compress.WithAlgorithm("x-level", &levelAlgo{name: name, cfg: compress.AlgorithmConfig{Enable: true, CompressLevel: 1}}),
+			compress.WithMaxCompressBytes(int64(len(largeBody)-1)),
+			large)
+
+		req, _ := http.NewRequest("GET", "/large", nil)
+		req.Header.Set("Accept-Encoding", "x-level")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, "x-level", w.Header().Get("Content-Encoding"))
+		assert.Equal(t, name+"9:"+largeBody, w.Body.String())
+	}
+
+	assert.Panics(t, func() {
+		compress.Compress(
+			compress.WithAlgorithm(compress.GZIP, &trailerAlgo{cfg: compress.AlgorithmConfig{Enable: true}}),
+			compress.WithLargeCompressLevel(compress.GZIP, compress.GzFlateBestSpeed))
+	})
+	assert.Panics(t, func() {
+		compress.Compress(compress.WithLargeCompressLevel("x-unknown", 1))
+	})
+}
+
+func TestAlgorithmChooser(t *testing.T) {
+	var result *compress.EncodingResult
+	var infos []*compress.ResponseInfo
+
+	r := setupResultRouter(&result, compress.WithAlgorithmChooser(func(info *compress.ResponseInfo) compress.Choice {
+		infos = append(infos, info)
+
+		switch {
+		case info.ContentType == "application/octet-stream":
+			return compress.Choice{}
+		case info.Size > 1024:
+			return compress.Choice{Coding: "gzip", Level: compress.GzFlateNoCompression, SetLevel: true}
+		default:
+			return compress.Choice{Coding: "zstd"}
+		}
+	}))
+	r.GET("/medium", func(c *gin.Context) {
+		c.String(200, largeBody[:1000])
+	})
+
+	req, _ := http.NewRequest("GET", "/large", nil)
+	req.Header.Set("Accept-Encoding", "br, gzip, zstd;q=0.5")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	checkCompress(t, w, "gzip")
+	assert.Greater(t, w.Body.Len(), len(largeBody))
+	assert.Equal(t, largeBody, decode(t, "gzip", w.Body.Bytes()))
+	if assert.Len(t, infos, 1) {
+		info := infos[0]
+		assert.Equal(t, []compress.Candidate{
+			{Coding: "br", Q: 1000, Priority: 400},
+			{Coding: "gzip", Q: 1000, Priority: 300},
+			{Coding: "zstd", Q: 500, Priority: 100},
+		}, info.Candidates)
+		assert.True(t, info.IdentityAllowed)
+		assert.Equal(t, "text/plain; charset=utf-8", info.ContentType)
+		assert.Equal(t, 200, info.Status)
+		assert.Equal(t, int64(len(largeBody)), info.Size)
+		assert.False(t, info.SizeDeclared)
+	}
+
+	req, _ = http.NewRequest("GET", "/medium", nil)
+	req.Header.Set("Accept-Encoding", "br, gzip, zstd;q=0.5")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	checkCompress(t, w, "zstd")
+	assert.Equal(t, largeBody[:1000], decode(t, "zstd", w.Body.Bytes()))
+	if assert.NotNil(t, result) {
+		assert.Equal(t, compress.DecisionEncoded, result.Decision)
+		assert.Equal(t, "zstd", result.Encoding)
+	}
+
+	req, _ = http.NewRequest("GET", "/random", nil)
+	req.Header.Set("Accept-Encoding", "br, gzip, zstd;q=0.5")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	if assert.NotNil(t, result) {
+		assert.Equal(t, compress.DecisionChooser, result.Decision)
+	}
+
+	// choices that the client doesn't accept fall back to the preferred candidate
+	req, _ = http.NewRequest("GET", "/medium", nil)
+	req.Header.Set("Accept-Encoding", "br")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	checkCompress(t, w, "br")
+	assert.Equal(t, largeBody[:1000], decode(t, "br", w.Body.Bytes()))
+}
+
+func TestAlgorithmChooserLevel(t *testing.T) {
+	chooser := compress.WithAlgorithmChooser(func(info *compress.ResponseInfo) compress.Choice {
+		return compress.Choice{Coding: "gzip", Level: 9, SetLevel: true}
+	})
+
+	// the level is applied to the middleware's own algorithm
+	r := setupRouter(
+		compress.WithAlgorithm(compress.GZIP, &levelAlgo{name: "a", cfg: compress.AlgorithmConfig{Enable: true, CompressLevel: 1}}),
+		chooser)
+
+	req, _ := http.NewRequest("GET", "/large", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "a9:"+largeBody, w.Body.String())
+
+	// algorithms that don't implement Leveler keep their configured level
+	r = setupRouter(
+		compress.WithAlgorithm(compress.GZIP, &trailerAlgo{cfg: compress.AlgorithmConfig{Enable: true}}),
+		chooser)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, largeBody+"TRAILER", w.Body.String())
+}
+
+func TestDeclaredLengthFastPath(t *testing.T) {
+	var rec *httptest.ResponseRecorder
+
+	r := gin.New()
+	r.Use(compress.Compress())
+
+	// the first chunk reaches the client before the rest of the response is written
+	r.GET("/declared", func(c *gin.Context) {
+		body := largeBody
+		if c.Query("size") == "small" {
+			body = smallBody
+		}
+
+		c.Header("Content-Type", "text/plain")
+		c.Header("Content-Length", strconv.Itoa(len(body)))
+		c.Status(200)
+
+		_, _ = c.Writer.WriteString(body[:4])
+		assert.NotZero(t, rec.Body.Len())
+		_, _ = c.Writer.WriteString(body[4:])
+	})
+
+	rec = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/declared?size=small", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, "", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+	assert.Equal(t, strconv.Itoa(len(smallBody)), rec.Header().Get("Content-Length"))
+	assert.Equal(t, smallBody, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/declared", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	r.ServeHTTP(rec, req)
+
+	checkCompress(t, rec, "gzip")
+	assert.Equal(t, "", rec.Header().Get("Content-Length"))
+	assert.Equal(t, largeBody, decode(t, "gzip", rec.Body.Bytes()))
+}
+
+var errEncoder = errors.New("encoder failed")
+
+// failingAlgo is an algorithm whose writer writes a header and then fails, and writes a trailer when closed
+type failingAlgo struct {
+	cfg compress.AlgorithmConfig
+}
+
+type failingWriter struct {
+	w io.Writer
+}
+
+func (f *failingWriter) Write(b []byte) (int, error) {
+	_, _ = f.w.Write([]byte("HEADER"))
+	return 0, errEncoder
+}
+
+func (f *failingWriter) Close() error {
+	_, err := f.w.Write([]byte("TRAILER"))
+	return err
+}
+
+func (a *failingAlgo) GetWriter(w io.Writer) io.WriteCloser {
+	return &failingWriter{w: w}
+}
+
+func (a *failingAlgo) GetReader(r io.Reader) (io.ReadCloser, error) {
+	return nil, errEncoder
+}
+
+func (a *failingAlgo) GetConfig() *compress.AlgorithmConfig {
+	return &a.cfg
+}
+
+func setupFailingRouter(errs *[]*gin.Error, opts ...compress.CompressOption) *gin.Engine {
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Next()
+		*errs = append(*errs, c.Errors.Last())
+	})
+
+	algo := &failingAlgo{cfg: compress.AlgorithmConfig{Enable: true, Priority: 1000}}
+	r.Use(compress.Compress(append([]compress.CompressOption{compress.WithAlgorithm("x-fail", algo)}, opts...)...))
+
+	// unlike c.String, this ignores write errors like most handlers do
+	r.GET("/large", func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain")
+		_, _ = c.Writer.WriteString(largeBody)
+	})
+
+	return r
+}
+
+func TestWriteErrors(t *testing.T) {
+	var errs []*gin.Error
+	var hooked error
+	r := setupFailingRouter(&errs, compress.WithErrorHandler(func(c *gin.Context, err error) {
+		hooked = err
+	}))
+
+	req, _ := http.NewRequest("GET", "/large", nil)
+	req.Header.Set("Accept-Encoding", "x-fail")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, "x-fail", w.Header().Get("Content-Encoding"))
+	// the incomplete response must not end with a trailer
+	assert.Equal(t, "HEADER", w.Body.String())
+	assert.ErrorIs(t, hooked, errEncoder)
+	if assert.Len(t, errs, 1) && assert.NotNil(t, errs[0]) {
+		assert.ErrorIs(t, errs[0].Err, errEncoder)
+	}
+}
+
+func TestAbortOnError(t *testing.T) {
+	var errs []*gin.Error
+	r := setupFailingRouter(&errs, compress.WithAbortOnError(true))
+
+	req, _ := http.NewRequest("GET", "/large", nil)
+	req.Header.Set("Accept-Encoding", "x-fail")
+	w := httptest.NewRecorder()
+
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		r.ServeHTTP(w, req)
+	})
+
+	// successful responses are unaffected
+	req.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	checkCompress(t, w, "gzip")
+	assert.Equal(t, largeBody, decode(t, "gzip", w.Body.Bytes()))
+}
+
+func TestAbortOnErrorRecovery(t *testing.T) {
+	// the handler finishes on the server's goroutine after the client has seen the connection close
+	errs := make(chan *gin.Error, 1)
+
+	// the connection is closed even though Recovery would swallow a panic
+	r := gin.New()
+	r.Use(gin.Recovery())
+	r.Use(func(c *gin.Context) {
+		defer func() {
+			errs <- c.Errors.Last()
+		}()
+		c.Next()
+	})
+
+	algo := &failingAlgo{cfg: compress.AlgorithmConfig{Enable: true, Priority: 1000}}
+	r.Use(compress.Compress(compress.WithAlgorithm("x-fail", algo), compress.WithAbortOnError(true)))
+	r.GET("/large", func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain")
+		_, _ = c.Writer.WriteString(largeBody)
+	})
+	// c.String panics when the write fails
+	r.GET("/render", func(c *gin.Context) {
+		c.String(200, largeBody)
+	})
+
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for _, path := range []string{"/large", "/render"} {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		req.Header.Set("Accept-Encoding", "x-fail")
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err, path) {
+			return
+		}
+
+		assert.Equal(t, "x-fail", resp.Header.Get("Content-Encoding"), path)
+		_, err = ioutil.ReadAll(resp.Body)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF, path)
+		_ = resp.Body.Close()
+
+		select {
+		case err := <-errs:
+			assert.ErrorIs(t, err, errEncoder, path)
+		case <-time.After(5 * time.Second):
+			t.Error("the handler did not finish", path)
+		}
+	}
+}
+
+func TestRenderWriteErrors(t *testing.T) {
+	var result *compress.EncodingResult
+	var hooked error
+
+	r := gin.New()
+	r.Use(gin.Recovery())
+	r.Use(func(c *gin.Context) {
+		defer func() {
+			if v, ok := c.Get(compress.ResultKey); ok {
+				result = v.(*compress.EncodingResult)
+			}
+		}()
+		c.Next()
+	})
+
+	algo := &failingAlgo{cfg: compress.AlgorithmConfig{Enable: true, Priority: 1000}}
+	r.Use(compress.Compress(compress.WithAlgorithm("x-fail", algo), compress.WithErrorHandler(func(c *gin.Context, err error) {
+		hooked = err
+	})))
+	r.GET("/render", func(c *gin.Context) {
+		c.String(200, largeBody)
+	})
+
+	req, _ := http.NewRequest("GET", "/render", nil)
+	req.Header.Set("Accept-Encoding", "x-fail")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	// the panic from c.String is reported like any other write error
+	assert.Equal(t, "HEADER", w.Body.String())
+	assert.ErrorIs(t, hooked, errEncoder)
+	if assert.NotNil(t, result) {
+		assert.ErrorIs(t, result.Err, errEncoder)
+	}
+}
+
+// trailerAlgo is an algorithm that writes its input as-is, followed by a trailer when closed
+type trailerAlgo struct {
+	cfg    compress.AlgorithmConfig
+	closes int
+}
+
+type trailerWriter struct {
+	a *trailerAlgo
+	w io.Writer
+}
+
+func (t *trailerWriter) Write(b []byte) (int, error) {
+	return t.w.Write(b)
+}
+
+func (t *trailerWriter) Close() error {
+	t.a.closes++
+	_, err := t.w.Write([]byte("TRAILER"))
+	return err
+}
+
+func (a *trailerAlgo) GetWriter(w io.Writer) io.WriteCloser {
+	return &trailerWriter{a: a, w: w}
+}
+
+func (a *trailerAlgo) GetReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+func (a *trailerAlgo) GetConfig() *compress.AlgorithmConfig {
+	return &a.cfg
+}
+
+func TestHandlerPanic(t *testing.T) {
+	var recovered interface{}
+	algo := &trailerAlgo{cfg: compress.AlgorithmConfig{Enable: true, Priority: 1000}}
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		defer func() {
+			if recovered = recover(); recovered != nil {
+				c.String(500, "recovered")
+			}
+		}()
+		c.Next()
+	})
+	r.Use(compress.Compress(compress.WithAlgorithm("x-trailer", algo)))
+
+	r.GET("/panic", func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain")
+		if c.Query("size") == "large" {
+			_, _ = c.Writer.WriteString(largeBody)
+		} else {
+			_, _ = c.Writer.WriteString(smallBody)
+		}
+		panic("boom")
+	})
+	r.GET("/large", func(c *gin.Context) {
+		c.String(200, largeBody)
+	})
+
+	// the encoded response is cut short without a trailer, and the compressor is released
+	req, _ := http.NewRequest("GET", "/panic?size=large", nil)
+	req.Header.Set("Accept-Encoding", "x-trailer")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, "boom", recovered)
+	assert.Equal(t, "x-trailer", w.Header().Get("Content-Encoding"))
+	assert.True(t, strings.HasPrefix(w.Body.String(), largeBody))
+	assert.NotContains(t, w.Body.String(), "TRAILER")
+	assert.Equal(t, 1, algo.closes)
+
+	// nothing was sent yet, so the recovering middleware can respond normally
+	recovered = nil
+	req, _ = http.NewRequest("GET", "/panic", nil)
+	req.Header.Set("Accept-Encoding", "x-trailer")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, "boom", recovered)
+	assert.Equal(t, 500, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "recovered", w.Body.String())
+
+	// brotli holds on to its output, so nothing was sent and the headers set by the handler are restored
+	br := gin.New()
+	br.Use(gin.Recovery(), compress.Compress())
+	br.GET("/panic", func(c *gin.Context) {
+		c.Header("ETag", `"abc"`)
+		c.Header("Vary", "Origin")
+		c.String(200, largeBody)
+		panic("boom")
+	})
+
+	req, _ = http.NewRequest("GET", "/panic", nil)
+	req.Header.Set("Accept-Encoding", "br")
+	w = httptest.NewRecorder()
+	br.ServeHTTP(w, req)
+
+	assert.Equal(t, 500, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, `"abc"`, w.Header().Get("ETag"))
+	assert.Equal(t, []string{"Origin"}, w.Header().Values("Vary"))
+	assert.Equal(t, "", w.Body.String())
+
+	// pooled compressors still work after a panic
+	for i := 0; i < 2; i++ {
+		req, _ = http.NewRequest("GET", "/panic?size=large", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		r.ServeHTTP(httptest.NewRecorder(), req)
+
+		req, _ = http.NewRequest("GET", "/large", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		checkCompress(t, w, "gzip")
+		assert.Equal(t, largeBody, decode(t, "gzip", w.Body.Bytes()))
+	}
+}
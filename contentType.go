@@ -0,0 +1,87 @@
+package compress
+
+/*
+gin-compress Copyright (C) 2022 Aurora McGinnis
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+
+import (
+	"path"
+	"strings"
+)
+
+// DefaultExcludedContentTypes lists the media types that are not compressed unless WithExcludeContentTypes is used.
+// These formats are already compressed, so compressing them again wastes CPU for little or no gain.
+var DefaultExcludedContentTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"image/avif",
+	"image/heic",
+	"image/heif",
+	"video/*",
+	"audio/aac",
+	"audio/mp4",
+	"audio/mpeg",
+	"audio/ogg",
+	"audio/opus",
+	"audio/webm",
+	"font/woff",
+	"font/woff2",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/zstd",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/vnd.rar",
+}
+
+// normalizeContentTypes lower-cases the patterns and verifies that they are valid
+func normalizeContentTypes(patterns []string) []string {
+	normalized := make([]string, 0, len(patterns))
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if _, err := path.Match(pattern, ""); err != nil {
+			panic("invalid content type pattern " + pattern)
+		}
+
+		normalized = append(normalized, pattern)
+	}
+
+	return normalized
+}
+
+// matchContentType returns true if mediaType matches any of the patterns. In patterns, * matches any sequence of
+// characters other than /, so text/* or application/*+json may be used.
+func matchContentType(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, mediaType); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compressibleContentType returns true if a response with the given Content-Type may be compressed
+func (co *compressOptions) compressibleContentType(contentType string) bool {
+	mediaType := contentType
+	if i := strings.IndexByte(mediaType, ';'); i >= 0 {
+		mediaType = mediaType[:i]
+	}
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+	if len(co.includeContentTypes) > 0 && !matchContentType(co.includeContentTypes, mediaType) {
+		return false
+	}
+
+	return !matchContentType(co.excludeContentTypes, mediaType)
+}
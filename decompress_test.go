@@ -2,13 +2,17 @@ package compress_test
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/andybalholm/brotli"
 	"github.com/aurowora/compress"
+	"github.com/gin-gonic/gin"
 	"github.com/klauspost/compress/gzip"
 	"github.com/klauspost/compress/zlib"
 	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -23,12 +27,11 @@ License, v. 2.0. If a copy of the MPL was not distributed with this
 file, You can obtain one at https://mozilla.org/MPL/2.0/.
 */
 
-// disable all algos
+// never compress responses, disabling the algorithms would also disable decompressing requests
 var dcOpts = []compress.CompressOption{
-	compress.WithAlgo("gzip", false),
-	compress.WithAlgo("br", false),
-	compress.WithAlgo("zstd", false),
-	compress.WithAlgo("deflate", false),
+	compress.WithExcludeFunc(func(c *gin.Context) bool {
+		return true
+	}),
 }
 
 var lol = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAH"
@@ -147,13 +150,9 @@ func TestMultipleDecompressions1(t *testing.T) {
 }
 
 func TestMultipleDecompressions2(t *testing.T) {
-	var sDcOpts = []compress.CompressOption{
-		compress.WithAlgo("gzip", false),
-		compress.WithAlgo("br", false),
-		compress.WithAlgo("zstd", false),
-		compress.WithAlgo("deflate", false),
+	sDcOpts := append(dcOpts,
 		compress.WithMaxDecodeSteps(2),
-	}
+	)
 	r := setupRouter(sDcOpts...)
 
 	b := bytes.NewBuffer(nil)
@@ -178,13 +177,9 @@ func TestMultipleDecompressions2(t *testing.T) {
 }
 
 func TestMultipleDecompressions3(t *testing.T) {
-	var sDcOpts = []compress.CompressOption{
-		compress.WithAlgo("gzip", false),
-		compress.WithAlgo("br", false),
-		compress.WithAlgo("zstd", false),
-		compress.WithAlgo("deflate", false),
+	sDcOpts := append(dcOpts,
 		compress.WithMaxDecodeSteps(4),
-	}
+	)
 	r := setupRouter(sDcOpts...)
 
 	b := bytes.NewBuffer(nil)
@@ -206,3 +201,292 @@ func TestMultipleDecompressions3(t *testing.T) {
 	assert.Equal(t, "gzipButDifferentLol", w.Header().Get("X-Request-Content-Encoding"))
 	assert.Equal(t, "200", fmt.Sprintf("%v", w.Code))
 }
+
+func TestStrictDecompressionUnsupported(t *testing.T) {
+	r := setupRouter(append(dcOpts, compress.WithStrictDecompression(true))...)
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("POST", "/echo", strings.NewReader(lol))
+	req.Header.Set("Content-Encoding", "snappy")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, "415", fmt.Sprintf("%v", w.Code))
+	assert.Equal(t, "br, gzip, deflate, zstd", w.Header().Get("Accept-Encoding"))
+}
+
+func TestStrictDecompressionTooManySteps(t *testing.T) {
+	r := setupRouter(append(dcOpts, compress.WithStrictDecompression(true))...)
+
+	b := bytes.NewBuffer(nil)
+	z := zlib.NewWriter(b)
+	g := gzip.NewWriter(z)
+	_, err := g.Write([]byte(lol))
+	assert.NoError(t, err)
+	assert.NoError(t, g.Close())
+	assert.NoError(t, z.Close())
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("POST", "/echo", b)
+	req.Header.Set("Content-Encoding", "gzip, deflate")
+	r.ServeHTTP(w, req)
+
+	// every coding could be decoded, so a 415 advertising them would not help the client
+	assert.Equal(t, "400", fmt.Sprintf("%v", w.Code))
+	assert.Equal(t, "", w.Header().Get("Accept-Encoding"))
+}
+
+func TestDecompressDisabledAlgorithm(t *testing.T) {
+	r := setupRouter(append(dcOpts, compress.WithAlgo(compress.BROTLI, false), compress.WithStrictDecompression(true))...)
+
+	b := bytes.NewBuffer(nil)
+	bc := brotli.NewWriter(b)
+	_, err := bc.Write([]byte(lol))
+	assert.NoError(t, err)
+	assert.NoError(t, bc.Close())
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/echo", b)
+	req.Header.Set("Content-Encoding", "br")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 415, w.Code)
+	assert.NotContains(t, w.Header().Get("Accept-Encoding"), "br")
+	assert.Contains(t, w.Header().Get("Accept-Encoding"), "gzip, deflate, zstd")
+}
+
+func TestStrictDecompressionSupported(t *testing.T) {
+	r := setupRouter(append(dcOpts, compress.WithStrictDecompression(true))...)
+
+	b := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(b)
+	_, err := gz.Write([]byte(lol))
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("POST", "/echo", b)
+	req.Header.Set("Content-Encoding", "identity, X-GZIP")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, "200", fmt.Sprintf("%v", w.Code))
+	assert.Equal(t, "", w.Header().Get("X-Request-Content-Encoding"))
+	assert.Equal(t, lol, w.Body.String())
+}
+
+func gzipBody(t *testing.T, body string) *bytes.Buffer {
+	b := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(b)
+	_, err := gz.Write([]byte(body))
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+
+	return b
+}
+
+func TestMaxDecompressedBytes(t *testing.T) {
+	r := setupRouter(append(dcOpts, compress.WithMaxDecompressedBytes(1024))...)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/drain", gzipBody(t, lolLarge))
+	req.Header.Set("Content-Encoding", "gzip")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, "413", fmt.Sprintf("%v", w.Code))
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/drain", gzipBody(t, lol))
+	req.Header.Set("Content-Encoding", "gzip")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, "204", fmt.Sprintf("%v", w.Code))
+}
+
+func TestMaxDecompressionRatio(t *testing.T) {
+	r := setupRouter(append(dcOpts, compress.WithMaxDecompressionRatio(100))...)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/drain", gzipBody(t, lolLarge))
+	req.Header.Set("Content-Encoding", "gzip")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, "413", fmt.Sprintf("%v", w.Code))
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/drain", gzipBody(t, largeBody))
+	req.Header.Set("Content-Encoding", "gzip")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, "204", fmt.Sprintf("%v", w.Code))
+}
+
+func TestDecompressionLimitError(t *testing.T) {
+	r := gin.New()
+	r.Use(compress.Compress(compress.WithMaxDecompressedBytes(1024)))
+
+	var limitErr *compress.DecompressionLimitError
+	var n int64
+	r.POST("/", func(c *gin.Context) {
+		var err error
+		n, err = io.Copy(ioutil.Discard, c.Request.Body)
+		if errors.As(err, &limitErr) {
+			c.String(400, "too big")
+		}
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/", gzipBody(t, lolLarge))
+	req.Header.Set("Content-Encoding", "gzip")
+	r.ServeHTTP(w, req)
+
+	// the handler's body is sent, but the status reflects the limit
+	assert.Equal(t, "413", fmt.Sprintf("%v", w.Code))
+	assert.Equal(t, "too big", w.Body.String())
+	assert.Equal(t, int64(1024), n)
+	if assert.NotNil(t, limitErr) {
+		assert.Equal(t, int64(1024), limitErr.Decompressed)
+		assert.False(t, limitErr.Ratio)
+	}
+}
+
+func TestDecompressionLimitAbort(t *testing.T) {
+	r := gin.New()
+	r.Use(compress.Compress(compress.WithMaxDecompressedBytes(1024)))
+	r.POST("/", func(c *gin.Context) {
+		if _, err := io.Copy(ioutil.Discard, c.Request.Body); err != nil {
+			c.AbortWithStatus(400)
+		}
+	})
+
+	for _, acceptEncoding := range []string{"", "gzip"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/", gzipBody(t, lolLarge))
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, 413, w.Code, acceptEncoding)
+	}
+}
+
+func TestMinDecompressionRatioBytes(t *testing.T) {
+	small := strings.Repeat("A", 16*1024)
+
+	// small bodies may compress well beyond the ratio
+	r := setupRouter(append(dcOpts, compress.WithMaxDecompressionRatio(10))...)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/echo", gzipBody(t, small))
+	req.Header.Set("Content-Encoding", "gzip")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, small, w.Body.String())
+
+	r = setupRouter(append(dcOpts, compress.WithMaxDecompressionRatio(10), compress.WithMinDecompressionRatioBytes(0))...)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/drain", gzipBody(t, small))
+	req.Header.Set("Content-Encoding", "gzip")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 413, w.Code)
+}
+
+func TestDecompressMalformed(t *testing.T) {
+	r := setupRouter(append(dcOpts, compress.WithMaxDecodeSteps(2))...)
+
+	for _, enc := range []string{"gzip", "deflate", "gzip, deflate"} {
+		w := httptest.NewRecorder()
+
+		req, _ := http.NewRequest("POST", "/echo", strings.NewReader(lol))
+		req.Header.Set("Content-Encoding", enc)
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, "400", fmt.Sprintf("%v", w.Code), enc)
+	}
+}
+
+func TestDecompressorReuse(t *testing.T) {
+	r := setupRouter(dcOpts...)
+
+	for i := 0; i < 4; i++ {
+		for _, enc := range []string{"gzip", "deflate"} {
+			b := bytes.NewBuffer(nil)
+			if enc == "gzip" {
+				b = gzipBody(t, lol)
+			} else {
+				z := zlib.NewWriter(b)
+				_, err := z.Write([]byte(lol))
+				assert.NoError(t, err)
+				assert.NoError(t, z.Close())
+			}
+
+			// a malformed body in between must not poison the pooled decompressor
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/echo", strings.NewReader("garbage"))
+			req.Header.Set("Content-Encoding", enc)
+			r.ServeHTTP(w, req)
+			assert.Equal(t, "400", fmt.Sprintf("%v", w.Code))
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/echo", b)
+			req.Header.Set("Content-Encoding", enc)
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, "200", fmt.Sprintf("%v", w.Code))
+			assert.Equal(t, lol, w.Body.String())
+		}
+	}
+}
+
+func TestDecompressNoTransform(t *testing.T) {
+	// requests with no-transform are decompressed by default
+	r := setupRouter(dcOpts...)
+
+	req, _ := http.NewRequest("POST", "/echo", gzipBody(t, lol))
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Cache-Control", "no-transform")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, lol, w.Body.String())
+
+	r = setupRouter(append(dcOpts, compress.WithDecompressNoTransform(false), compress.WithStrictDecompression(true))...)
+
+	req, _ = http.NewRequest("POST", "/echo", gzipBody(t, lol))
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Cache-Control", "no-transform")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("X-Request-Content-Encoding"))
+	assert.Equal(t, gzipBody(t, lol).Bytes(), w.Body.Bytes())
+}
+
+func TestDecompressHandlerCloses(t *testing.T) {
+	r := gin.New()
+	r.Use(compress.Compress(dcOpts...))
+	r.POST("/close", func(c *gin.Context) {
+		b, err := ioutil.ReadAll(c.Request.Body)
+		assert.NoError(t, err)
+		// the middleware closes the body again once the handler returns
+		assert.NoError(t, c.Request.Body.Close())
+
+		c.Data(200, "text/plain", b)
+	})
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", "/close", gzipBody(t, lol))
+		req.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, lol, w.Body.String())
+	}
+}
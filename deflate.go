@@ -17,12 +17,45 @@ file, You can obtain one at https://mozilla.org/MPL/2.0/.
 */
 
 type algorithmDeflate struct {
-	compressorPool *sync.Pool
-	cfg            algorithmConfig
+	compressorPool   *sync.Pool
+	decompressorPool *sync.Pool
+	cfg              AlgorithmConfig
+}
+
+// zlibDecompressor allows the zlib reader to be pooled. zlib.NewReader requires a valid stream, so the reader is
+// constructed the first time the decompressor is Reset with a real body.
+type zlibDecompressor struct {
+	zr io.ReadCloser
+}
+
+func (z *zlibDecompressor) Read(b []byte) (int, error) {
+	return z.zr.Read(b)
+}
+
+func (z *zlibDecompressor) Reset(r io.Reader) error {
+	if z.zr == nil {
+		if r == nil {
+			return nil
+		}
+
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			return err
+		}
+
+		z.zr = zr
+		return nil
+	}
+
+	if r == nil {
+		r = eofReader{}
+	}
+
+	return z.zr.(zlib.Resetter).Reset(r, nil)
 }
 
 func (a *algorithmDeflate) makeCompressor() interface{} {
-	dw, err := zlib.NewWriterLevel(ioutil.Discard, a.cfg.compressLevel)
+	dw, err := zlib.NewWriterLevel(ioutil.Discard, a.cfg.CompressLevel)
 	if err != nil {
 		panic(err)
 	}
@@ -30,13 +63,13 @@ func (a *algorithmDeflate) makeCompressor() interface{} {
 	return dw
 }
 
-/* Implement algorithm */
+/* Implement Algorithm */
 
-func (a *algorithmDeflate) getConfig() *algorithmConfig {
+func (a *algorithmDeflate) GetConfig() *AlgorithmConfig {
 	return &a.cfg
 }
 
-func (a *algorithmDeflate) getWriter(w io.Writer) io.WriteCloser {
+func (a *algorithmDeflate) GetWriter(w io.Writer) io.WriteCloser {
 	dw := a.compressorPool.Get().(*zlib.Writer)
 	dw.Reset(w)
 
@@ -46,21 +79,39 @@ func (a *algorithmDeflate) getWriter(w io.Writer) io.WriteCloser {
 	}
 }
 
-func (a *algorithmDeflate) getReader(r io.Reader) io.ReadCloser {
-	dr, err := zlib.NewReader(r)
-	if err != nil {
-		panic(err)
+func (a *algorithmDeflate) GetReader(r io.Reader) (io.ReadCloser, error) {
+	dr := a.decompressorPool.Get().(*zlibDecompressor)
+	if err := dr.Reset(r); err != nil {
+		a.decompressorPool.Put(dr)
+		return nil, err
 	}
 
-	return dr
+	return &wrappedReader{
+		p: a.decompressorPool,
+		r: dr,
+	}, nil
+}
+
+// WithLevel returns a new deflate algorithm with the same configuration and its own pools, which uses level
+func (a *algorithmDeflate) WithLevel(level int) Algorithm {
+	b := newAlgorithmDeflate()
+	b.cfg = a.cfg
+	b.cfg.CompressLevel = level
+
+	return b
 }
 
 func newAlgorithmDeflate() *algorithmDeflate {
 	a := algorithmDeflate{
-		cfg: algorithmConfig{
-			priority:      200,
-			enable:        true,
-			compressLevel: GzFlateDefault,
+		cfg: AlgorithmConfig{
+			Priority:      200,
+			Enable:        true,
+			CompressLevel: GzFlateDefault,
+		},
+		decompressorPool: &sync.Pool{
+			New: func() interface{} {
+				return new(zlibDecompressor)
+			},
 		},
 	}
 
@@ -0,0 +1,136 @@
+package compress
+
+/*
+gin-compress Copyright (C) 2022 Aurora McGinnis
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ETagPolicy determines how strong ETags set by the handler are changed when the response is encoded, since the
+// encoded representation is not byte-for-byte identical to the unencoded one. Weak ETags are never changed.
+type ETagPolicy int
+
+const (
+	// ETagSuffix appends the content coding to the ETag, e.g. "abc" becomes "abc-br". If-None-Match headers that
+	// refer to a suffixed ETag are translated back before the handler sees them.
+	ETagSuffix ETagPolicy = iota
+	// ETagWeaken turns the ETag into a weak ETag, e.g. "abc" becomes W/"abc". Handlers must use the weak comparison
+	// for If-None-Match, as RFC 9110 requires, to recognize it.
+	ETagWeaken
+	// ETagKeep leaves the ETag unchanged
+	ETagKeep
+)
+
+// encodedETag returns the ETag of the representation of etag that is encoded using coding
+func encodedETag(etag string, coding string, policy ETagPolicy) string {
+	if !isStrongETag(etag) {
+		return etag
+	}
+
+	switch policy {
+	case ETagSuffix:
+		return etag[:len(etag)-1] + "-" + coding + `"`
+	case ETagWeaken:
+		return "W/" + etag
+	default:
+		return etag
+	}
+}
+
+// isStrongETag returns true if etag is a well-formed strong entity tag
+func isStrongETag(etag string) bool {
+	return len(etag) >= 2 && etag[0] == '"' && etag[len(etag)-1] == '"' && !strings.Contains(etag[1:len(etag)-1], `"`)
+}
+
+// parseETags splits an If-None-Match or If-Match header into its entity tags. Elements that aren't entity tags are
+// returned as-is, so the header can be reassembled.
+func parseETags(header string) []string {
+	var etags []string
+
+	for header = trimOWS(header); header != ""; header = trimOWS(header) {
+		if header[0] == ',' {
+			header = header[1:]
+			continue
+		}
+
+		// entity tags may contain commas, so the end of each one is found by its closing quote
+		start := 0
+		if strings.HasPrefix(header, `W/"`) {
+			start = 2
+		}
+
+		end := strings.IndexByte(header, ',')
+		if header[start] == '"' {
+			if closing := strings.IndexByte(header[start+1:], '"'); closing >= 0 {
+				end = start + closing + 2
+			}
+		}
+		if end < 0 {
+			end = len(header)
+		}
+
+		etags = append(etags, trimOWS(header[:end]))
+		header = header[end:]
+	}
+
+	return etags
+}
+
+// translateIfNoneMatch replaces entity tags in If-None-Match that were suffixed for one of codings with the ETag set by
+// the handler, so that handlers comparing ETags see their own value.
+func (cm *compressMiddleware) translateIfNoneMatch(c *gin.Context, codings []string) {
+	values := c.Request.Header.Values("If-None-Match")
+	if cm.cfg.etagPolicy != ETagSuffix || len(values) == 0 {
+		return
+	}
+
+	etags := parseETags(strings.Join(values, ","))
+	for i, etag := range etags {
+		if !isStrongETag(etag) {
+			continue
+		}
+
+		for _, coding := range codings {
+			suffix := "-" + coding + `"`
+			if len(etag) > len(suffix) && strings.HasSuffix(etag, suffix) {
+				etags[i] = etag[:len(etag)-len(suffix)] + `"`
+				break
+			}
+		}
+	}
+
+	c.Request.Header.Set("If-None-Match", strings.Join(etags, ", "))
+}
+
+// setEncodedETag changes the ETag of an encoded response according to cfg.etagPolicy
+func (rw *respWriter) setEncodedETag() {
+	if etag := rw.Header().Get("ETag"); etag != "" {
+		rw.Header().Set("ETag", encodedETag(etag, rw.encoding, rw.cfg.etagPolicy))
+	}
+}
+
+// revalidateETag changes the ETag of a 304 Not Modified response to the encoded ETag if that is what the client
+// asked about, as the 304 must identify the representation that the client has cached
+func (rw *respWriter) revalidateETag() {
+	etag := rw.Header().Get("ETag")
+	if etag == "" || rw.cfg.etagPolicy == ETagKeep {
+		return
+	}
+
+	for _, requested := range parseETags(rw.ifNoneMatch) {
+		for _, coding := range rw.codings() {
+			if encoded := encodedETag(etag, coding, rw.cfg.etagPolicy); requested == encoded {
+				rw.Header().Set("ETag", encoded)
+				return
+			}
+		}
+	}
+}
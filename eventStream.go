@@ -0,0 +1,86 @@
+package compress
+
+/*
+gin-compress Copyright (C) 2022 Aurora McGinnis
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+
+import (
+	"bytes"
+	"mime"
+	"time"
+)
+
+// EventStreamFlush determines when a compressed event stream is flushed to the client
+type EventStreamFlush int
+
+const (
+	// FlushOnWrite flushes the compressor after every write
+	FlushOnWrite EventStreamFlush = iota
+	// FlushOnEvent flushes the compressor whenever a write completes an event, i.e. contains a blank line
+	FlushOnEvent
+	// FlushOnInterval flushes pending data periodically, see WithEventStreamFlushInterval
+	FlushOnInterval
+)
+
+// eventStreamMediaType is the Content-Type of Server-Sent Events
+const eventStreamMediaType = "text/event-stream"
+
+// eventBoundaries are the blank lines that end an event, see https://html.spec.whatwg.org/multipage/server-sent-events.html
+var eventBoundaries = [][]byte{[]byte("\n\n"), []byte("\r\r"), []byte("\r\n\r\n")}
+
+// isEventStream returns true if the response is an event stream that should be compressed
+func (rw *respWriter) isEventStream() bool {
+	if !rw.cfg.eventStreams {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(rw.Header().Get("Content-Type"))
+	return err == nil && mediaType == eventStreamMediaType
+}
+
+// afterEventStreamWrite applies the flush policy once b has been written to the compressor. mu must be held.
+func (rw *respWriter) afterEventStreamWrite(b []byte) {
+	switch rw.cfg.eventStreamFlush {
+	case FlushOnWrite:
+		rw.flushLocked()
+	case FlushOnEvent:
+		// boundaries may be split across writes, so also check the end of the last write joined with this one
+		seam := append(rw.eventTail, b[:minInt(len(b), 3)]...)
+		found := false
+		for _, boundary := range eventBoundaries {
+			if bytes.Contains(seam, boundary) || bytes.Contains(b, boundary) {
+				found = true
+				break
+			}
+		}
+
+		end := b
+		if len(b) < 3 {
+			end = seam
+		}
+		rw.eventTail = append(rw.eventTail[:0], end[len(end)-minInt(len(end), 3):]...)
+
+		if found {
+			rw.flushLocked()
+		}
+	case FlushOnInterval:
+		if rw.flushTimer == nil {
+			rw.flushTimer = time.AfterFunc(rw.cfg.eventStreamFlushInterval, rw.flushEventStream)
+		}
+	}
+}
+
+// flushEventStream is called by the flush timer
+func (rw *respWriter) flushEventStream() {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	rw.flushTimer = nil
+	if !rw.closed {
+		rw.flushLocked()
+	}
+}
@@ -17,12 +17,27 @@ file, You can obtain one at https://mozilla.org/MPL/2.0/.
 */
 
 type algorithmGzip struct {
-	compressorPool *sync.Pool
-	cfg            algorithmConfig
+	compressorPool   *sync.Pool
+	decompressorPool *sync.Pool
+	cfg              AlgorithmConfig
+}
+
+// gzipDecompressor allows gzip.Reader to be pooled. The zero value of gzip.Reader is only initialized once it is
+// Reset with a real body, and resetting it with nil would panic while reading the header.
+type gzipDecompressor struct {
+	gzip.Reader
+}
+
+func (g *gzipDecompressor) Reset(r io.Reader) error {
+	if r == nil {
+		r = eofReader{}
+	}
+
+	return g.Reader.Reset(r)
 }
 
 func (a *algorithmGzip) makeCompressor() interface{} {
-	gz, err := gzip.NewWriterLevel(ioutil.Discard, a.cfg.compressLevel)
+	gz, err := gzip.NewWriterLevel(ioutil.Discard, a.cfg.CompressLevel)
 	if err != nil {
 		panic(err)
 	}
@@ -30,13 +45,13 @@ func (a *algorithmGzip) makeCompressor() interface{} {
 	return gz
 }
 
-/* Implement algorithm */
+/* Implement Algorithm */
 
-func (a *algorithmGzip) getConfig() *algorithmConfig {
+func (a *algorithmGzip) GetConfig() *AlgorithmConfig {
 	return &a.cfg
 }
 
-func (a *algorithmGzip) getWriter(w io.Writer) io.WriteCloser {
+func (a *algorithmGzip) GetWriter(w io.Writer) io.WriteCloser {
 	gw := a.compressorPool.Get().(*gzip.Writer)
 	gw.Reset(w)
 
@@ -46,24 +61,39 @@ func (a *algorithmGzip) getWriter(w io.Writer) io.WriteCloser {
 	}
 }
 
-func (a *algorithmGzip) getReader(r io.Reader) io.ReadCloser {
-	// gzip reader implements Reset, but isn't usable with a sync pool
-	// because it'll panic when you try to construct one with a nil
-	// reader
-	gr, err := gzip.NewReader(r)
-	if err != nil {
-		panic(err)
+func (a *algorithmGzip) GetReader(r io.Reader) (io.ReadCloser, error) {
+	gr := a.decompressorPool.Get().(*gzipDecompressor)
+	if err := gr.Reset(r); err != nil {
+		a.decompressorPool.Put(gr)
+		return nil, err
 	}
 
-	return gr
+	return &wrappedReader{
+		p: a.decompressorPool,
+		r: gr,
+	}, nil
+}
+
+// WithLevel returns a new gzip algorithm with the same configuration and its own pools, which uses level
+func (a *algorithmGzip) WithLevel(level int) Algorithm {
+	b := newAlgorithmGzip()
+	b.cfg = a.cfg
+	b.cfg.CompressLevel = level
+
+	return b
 }
 
 func newAlgorithmGzip() *algorithmGzip {
 	a := algorithmGzip{
-		cfg: algorithmConfig{
-			priority:      300,
-			enable:        true,
-			compressLevel: GzFlateDefault,
+		cfg: AlgorithmConfig{
+			Priority:      300,
+			Enable:        true,
+			CompressLevel: GzFlateDefault,
+		},
+		decompressorPool: &sync.Pool{
+			New: func() interface{} {
+				return new(gzipDecompressor)
+			},
 		},
 	}
 
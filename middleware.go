@@ -9,14 +9,24 @@ file, You can obtain one at https://mozilla.org/MPL/2.0/.
 */
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"sort"
-	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
+// ErrUnsupportedContentEncoding is returned (wrapped) when the request body uses a content coding that cannot be decoded
+var ErrUnsupportedContentEncoding = errors.New("unsupported Content-Encoding")
+
+// ErrTooManyContentEncodings is returned (wrapped) when the request body uses more content codings than
+// WithMaxDecodeSteps allows, even though each of them could be decoded
+var ErrTooManyContentEncodings = errors.New("too many Content-Encodings")
+
 type compressMiddleware struct {
 	cfg *compressOptions
 }
@@ -30,34 +40,153 @@ func newCompressMiddleware(opts *compressOptions) (cm *compressMiddleware) {
 }
 
 func (cm *compressMiddleware) Handler(c *gin.Context) {
-	if cf, err := cm.decompressRequest(c); err != nil {
-		_ = c.AbortWithError(400, err)
+	if br, err := cm.decompressRequest(c); err != nil {
+		if errors.Is(err, ErrUnsupportedContentEncoding) {
+			// advertise what we can decode, as described in RFC 7694
+			c.Header("Accept-Encoding", strings.Join(cm.decodableEncodings(), ", "))
+			_ = c.AbortWithError(415, err)
+		} else {
+			_ = c.AbortWithError(400, err)
+		}
 		return
-	} else if cf != nil {
-		defer cf()
+	} else if br != nil {
+		defer cm.finishRequestBody(c, br)
+
+		if br.limited() {
+			c.Writer = &bodyLimitWriter{ResponseWriter: c.Writer, body: br}
+		}
 	}
 
-	algo := cm.selectAlgorithm(c)
+	ae := cm.acceptEncoding(c)
+	candidates := cm.candidates(ae)
 
-	if algo == "" || !cm.shouldCompress(c) {
+	if cm.cfg.strictNegotiation && len(candidates) == 0 && !ae.IdentityAllowed() {
+		addVary(c.Writer.Header(), "Accept-Encoding")
+		cm.cfg.notAcceptableHandler(c)
+		c.Abort()
+		setUnencodedResult(c, DecisionNotAccepted)
+		return
+	}
+
+	if len(candidates) == 0 {
 		c.Next()
+		setUnencodedResult(c, DecisionNotAccepted)
+		return
+	} else if reason := cm.requestSkipReason(c); reason != "" {
+		c.Next()
+		setUnencodedResult(c, reason)
 		return
 	}
 
-	rw := newResponseWriter(c, cm.cfg.minCompressBytes, algo, algorithms[algo])
+	threshold := cm.cfg.minCompressBytes
+	if cm.cfg.strictNegotiation && !ae.IdentityAllowed() {
+		// the client cannot handle an unencoded response, no matter how small
+		threshold = 0
+	}
+
+	rw := newResponseWriter(c, cm.cfg, threshold, candidates, ae.IdentityAllowed())
+	cm.translateIfNoneMatch(c, rw.codings())
 	c.Writer = rw
+
+	completed := false
+	defer func() {
+		if !completed {
+			// the handler panicked. The panic continues once the compressor has been released, and anything the
+			// recovering middleware writes goes to the client as-is.
+			err := rw.abandon()
+			c.Writer = rw.ResponseWriter
+
+			if err != nil {
+				// gin's c.Render panics when a write fails, so this is how most handlers see write errors
+				c.Set(ResultKey, rw.result())
+				cm.writeFailed(c, err)
+			}
+		}
+	}()
+
 	c.Next()
+	completed = true
+
+	err := rw.Close()
+	c.Set(ResultKey, rw.result())
+	if err != nil {
+		cm.writeFailed(c, err)
+	}
+}
+
+// writeFailed reports an error that occurred while writing the response
+func (cm *compressMiddleware) writeFailed(c *gin.Context, err error) {
+	_ = c.Error(err)
 
-	_ = rw.Close()
+	if cm.cfg.errorHandler != nil {
+		cm.cfg.errorHandler(c, err)
+	}
+
+	if cm.cfg.abortOnError {
+		// closing the connection tells the client that the response is incomplete. Hijacking it means that a
+		// recovering middleware can't get in the way, which it could for the panic.
+		if conn, err := hijack(c.Writer); err == nil {
+			_ = conn.Close()
+			return
+		}
+
+		// net/http closes the connection without logging anything
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// hijack takes over the connection that w writes to. gin panics instead of returning an error if the connection
+// can't be hijacked (e.g. HTTP/2), so that is recovered here.
+func hijack(w gin.ResponseWriter) (conn net.Conn, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cannot hijack connection: %v", r)
+		}
+	}()
+
+	conn, _, err = w.Hijack()
+	return conn, err
+}
+
+// setUnencodedResult records the result for responses that the middleware did not wrap
+func setUnencodedResult(c *gin.Context, decision Decision) {
+	size := c.Writer.Size()
+	if size < 0 {
+		size = 0
+	}
+
+	c.Set(ResultKey, &EncodingResult{
+		Decision:    decision,
+		Size:        size,
+		EncodedSize: -1,
+	})
+}
+
+// finishRequestBody closes the decompressors and rejects the request if the body exceeded the decompression limits.
+// Responses that the handler started are rejected by bodyLimitWriter instead.
+func (cm *compressMiddleware) finishRequestBody(c *gin.Context, br *compressedBodyReader) {
+	_ = br.Close()
+
+	if err := br.exceeded(); err != nil {
+		_ = c.Error(err)
+
+		if !c.Writer.Written() {
+			c.AbortWithStatus(413)
+		}
+	}
 }
 
 // decompresses the request body, if one exists and Content-Encoding is specified
-func (cm *compressMiddleware) decompressRequest(c *gin.Context) (func() error, error) {
+func (cm *compressMiddleware) decompressRequest(c *gin.Context) (*compressedBodyReader, error) {
 	if cm.cfg.skipDecompressRequest {
 		return nil, nil
 	}
+	if !cm.cfg.decompressNoTransform && hasCacheDirective(c.Request.Header, "no-transform") {
+		// the handler receives the body exactly as the client sent it
+		return nil, nil
+	}
 
-	encodings := strings.Split(strings.ReplaceAll(c.GetHeader("Content-Encoding"), " ", ""), ",")
+	encodings := parseContentEncoding(c.Request.Header.Values("Content-Encoding"))
 	if len(encodings) == 0 || c.Request.Body == nil {
 		// nothing to do
 		return nil, nil
@@ -65,102 +194,185 @@ func (cm *compressMiddleware) decompressRequest(c *gin.Context) (func() error, e
 
 	// Content-Encodings are specified in the order they were applied,
 	// so we need to unapply them in the reverse order
-	readers := make([]io.ReadCloser, 0, len(encodings))
-	i := len(encodings) - 1
-	for ; i >= (len(encodings)-cm.cfg.maxDecodeSteps) && i >= 0; i-- {
-		enc := encodings[i]
+	steps := 0
+	for i := len(encodings) - 1; i >= 0 && steps < cm.cfg.maxDecodeSteps; i-- {
+		if !cm.decodable(encodings[i]) {
+			break
+		}
+		steps++
+	}
+	remaining := encodings[:len(encodings)-steps]
+
+	if len(remaining) > 0 && cm.cfg.strictDecompression {
+		for _, enc := range remaining {
+			if !cm.decodable(enc) {
+				return nil, fmt.Errorf("%w: %s", ErrUnsupportedContentEncoding, strings.Join(remaining, ", "))
+			}
+		}
+
+		// advertising these codings with a 415 would only make the client retry with them
+		return nil, fmt.Errorf("%w: %s", ErrTooManyContentEncodings, strings.Join(encodings, ", "))
+	}
+	if steps == 0 {
+		return nil, nil
+	}
 
-		w := c.Request.Body
+	source := &countingReader{r: c.Request.Body}
+	readers := make([]io.ReadCloser, 0, steps)
+	for i := len(encodings) - 1; i >= len(remaining); i-- {
+		var w io.Reader = source
 		if len(readers) > 0 {
 			w = readers[len(readers)-1]
 		}
 
-		if algo, ok := algorithms[enc]; ok {
-			r := algo.getReader(w)
-			readers = append(readers, r)
-		} else {
-			break
+		r, err := cm.cfg.algorithms[normalizeCoding(encodings[i])].GetReader(w)
+		if err != nil {
+			for _, r := range readers {
+				_ = r.Close()
+			}
+
+			return nil, err
 		}
-	}
-	if len(readers) == 0 {
-		return nil, nil
+		readers = append(readers, r)
 	}
 
 	c.Request.Header.Del("Content-Length")
-	if i <= -1 {
+	if len(remaining) == 0 {
 		c.Request.Header.Del("Content-Encoding")
 	} else {
-		c.Request.Header.Set("Content-Encoding", strings.Join(encodings[:i+1], ", "))
+		c.Request.Header.Set("Content-Encoding", strings.Join(remaining, ", "))
 	}
 
 	br := &compressedBodyReader{
-		decomps: readers,
+		decomps:       readers,
+		source:        source,
+		maxBytes:      cm.cfg.maxDecompressedBytes,
+		maxRatio:      cm.cfg.maxDecompressionRatio,
+		minRatioBytes: cm.cfg.minDecompressionRatioBytes,
 	}
 	c.Request.Body = br
 
-	return br.Close, nil
+	return br, nil
 }
 
-type acceptableEncoding struct {
-	encoding string
-	q        int
+// parseContentEncoding splits the Content-Encoding header values into the list of applied codings
+func parseContentEncoding(values []string) []string {
+	encodings := make([]string, 0, len(values))
+
+	for _, value := range values {
+		for _, enc := range strings.Split(value, ",") {
+			enc = trimOWS(enc)
+			if enc != "" && normalizeCoding(enc) != IDENTITY {
+				encodings = append(encodings, enc)
+			}
+		}
+	}
+
+	return encodings
 }
 
-func (cm *compressMiddleware) selectAlgorithm(c *gin.Context) string {
-	acceptEncodings := strings.ToLower(strings.ReplaceAll(c.GetHeader("Accept-Encoding"), " ", ""))
-	if acceptEncodings == "" {
-		return ""
+// decodable returns true if coding is an enabled algorithm that can be removed from request bodies
+func (cm *compressMiddleware) decodable(coding string) bool {
+	algo, ok := cm.cfg.algorithms[normalizeCoding(coding)]
+	return ok && algo.GetConfig().Enable
+}
+
+// decodableEncodings returns the codings that can be removed from request bodies, highest priority first
+func (cm *compressMiddleware) decodableEncodings() []string {
+	enabled := getEnabledAlgorithms(cm.cfg.algorithms)
+
+	encodings := make([]string, 0, len(enabled))
+	for enc := range enabled {
+		encodings = append(encodings, enc)
 	}
 
-	allowedEncodings := getEnabledAlgorithms()
+	sort.Slice(encodings, func(i int, j int) bool {
+		a, b := cm.cfg.algorithms[encodings[i]], cm.cfg.algorithms[encodings[j]]
 
-	// parse the Accept-Encoding header
-	encodings := strings.Split(acceptEncodings, ",")
-	acceptableEncodings := make([]acceptableEncoding, 0, len(encodings))
-	for _, encoding := range encodings {
-		parts := strings.Split(encoding, ";")
-		acc := acceptableEncoding{
-			encoding: parts[0],
-			q:        1000,
+		if a.GetConfig().Priority == b.GetConfig().Priority {
+			return encodings[i] < encodings[j]
+		} else {
+			return a.GetConfig().Priority > b.GetConfig().Priority
 		}
+	})
 
-		if len(parts) > 1 && strings.HasPrefix(parts[1], "q=") {
-			q, err := strconv.ParseFloat(parts[1][2:], 64)
-			if err != nil {
-				_ = c.Error(err)
-			} else {
-				acc.q = int(q * 1000)
-			}
-		}
+	return encodings
+}
+
+// acceptEncoding parses the Accept-Encoding headers of the request. Malformed headers are recorded on the context
+// and treated as though no coding was acceptable.
+func (cm *compressMiddleware) acceptEncoding(c *gin.Context) AcceptEncoding {
+	ae, err := ParseAcceptEncoding(strings.Join(c.Request.Header.Values("Accept-Encoding"), ","))
+	if err != nil {
+		_ = c.Error(err)
+		return nil
+	}
+
+	return ae
+}
+
+// candidates returns the enabled algorithms that the client accepts, most preferred first. Unlisted algorithms are
+// considered using the wildcard's q-value. It returns nil if the client prefers the response unencoded.
+func (cm *compressMiddleware) candidates(ae AcceptEncoding) []Candidate {
+	if len(ae) == 0 {
+		return nil
+	}
+
+	allowedEncodings := getEnabledAlgorithms(cm.cfg.algorithms)
 
-		// exclude any encodings that are not supported
-		if _, ok := allowedEncodings[acc.encoding]; ok && acc.q > 0 {
-			acceptableEncodings = append(acceptableEncodings, acc)
+	candidates := make([]Candidate, 0, len(allowedEncodings))
+	for encoding, algo := range allowedEncodings {
+		if q, ok := ae.Weight(encoding); ok && q > 0 {
+			candidates = append(candidates, Candidate{
+				Coding:   encoding,
+				Q:        q,
+				Priority: algo.GetConfig().Priority,
+			})
 		}
 	}
-	if len(acceptableEncodings) == 0 {
+	if len(candidates) == 0 {
 		// could not agree upon an algo
-		return ""
+		return nil
 	}
 
 	// sort the encodings by q-value first, then their priorities
-	sort.Slice(acceptableEncodings, func(i int, j int) bool {
-		a, b := acceptableEncodings[i], acceptableEncodings[j]
-
-		if a.q == b.q {
-			alA, alB := allowedEncodings[a.encoding], allowedEncodings[b.encoding]
-			return alA.getConfig().priority < alB.getConfig().priority
+	sort.Slice(candidates, func(i int, j int) bool {
+		a, b := candidates[i], candidates[j]
 
+		if a.Q != b.Q {
+			return a.Q > b.Q
+		} else if a.Priority != b.Priority {
+			return a.Priority > b.Priority
 		} else {
-			return a.q < b.q
+			return a.Coding < b.Coding
 		}
 	})
 
-	return acceptableEncodings[len(acceptableEncodings)-1].encoding
+	if q, ok := ae.Weight(IDENTITY); ok && q > candidates[0].Q {
+		// the client would rather have the response unencoded
+		return nil
+	}
+
+	return candidates
+}
+
+// requestSkipReason returns why the response to the request must not be encoded, or "" if it may be
+func (cm *compressMiddleware) requestSkipReason(c *gin.Context) Decision {
+	if !cm.shouldCompress(c) {
+		return DecisionExcluded
+	}
+	if hasCacheDirective(c.Request.Header, "no-transform") {
+		return DecisionNoTransform
+	}
+	if cm.skipRange(c) {
+		return DecisionRange
+	}
+
+	return ""
 }
 
 func (cm *compressMiddleware) shouldCompress(c *gin.Context) bool {
-	if strings.Contains(c.GetHeader("Accept"), "text/event-stream") ||
+	if (!cm.cfg.eventStreams && strings.Contains(c.GetHeader("Accept"), eventStreamMediaType)) ||
 		strings.Contains(c.GetHeader("Connection"), "Upgrade") {
 
 		return false
@@ -170,5 +382,5 @@ func (cm *compressMiddleware) shouldCompress(c *gin.Context) bool {
 		return false
 	}
 
-	return len(getEnabledAlgorithms()) > 0
+	return len(getEnabledAlgorithms(cm.cfg.algorithms)) > 0
 }
@@ -9,6 +9,9 @@ file, You can obtain one at https://mozilla.org/MPL/2.0/.
 */
 
 import (
+	"strings"
+	"time"
+
 	"github.com/gin-gonic/gin"
 	"github.com/klauspost/compress/flate"
 )
@@ -23,17 +26,76 @@ const (
 // ExcludeFunc should return true if compression should be skipped for the current request
 type ExcludeFunc func(c *gin.Context) bool
 
+// ErrorHandler is called with the first error encountered while writing a response
+type ErrorHandler func(c *gin.Context, err error)
+
+// StatusFunc should return true if responses with the given status code may be compressed
+type StatusFunc func(status int) bool
+
 // compressOptions is used to configure the Compress middleware. Use NewCompressOptionsBuilder() to create this.
 type compressOptions struct {
 	excludeFunc ExcludeFunc
 
+	// algorithms contains the algorithm instances owned by this middleware
+	algorithms map[string]Algorithm
+	// chooser selects the coding of each response once it is large enough to compress, if set
+	chooser AlgorithmChooser
+	// leveledAlgorithms contains the algorithm instances used when chooser overrides the level
+	leveledAlgorithms *leveledAlgorithms
+
+	// statusFunc decides which response status codes may be compressed, or all if nil
+	statusFunc StatusFunc
+
+	// includeContentTypes lists the response media types that may be compressed, or all if empty
+	includeContentTypes []string
+	// excludeContentTypes lists the response media types that must not be compressed
+	excludeContentTypes []string
+
+	// eventStreams enables compressing Server-Sent Events
+	eventStreams bool
+	// eventStreamFlush determines when compressed event streams are flushed
+	eventStreamFlush EventStreamFlush
+	// eventStreamFlushInterval is used by FlushOnInterval
+	eventStreamFlushInterval time.Duration
+
+	// rangePolicy determines how range requests are handled
+	rangePolicy RangePolicy
+	// etagPolicy determines how the ETags of encoded responses are changed
+	etagPolicy ETagPolicy
+
 	// minCompressBytes specifies the minimum size a response must be to justify compressing.
 	minCompressBytes int
+	// maxCompressBytes specifies the size above which responses are not compressed using algorithms, <= 0 means unlimited
+	maxCompressBytes int64
+	// largeAlgorithms contains cheaper instances of algorithms that are used for responses above maxCompressBytes
+	largeAlgorithms map[string]Algorithm
+	// bufferBytes specifies the size up to which responses are buffered and compressed in memory
+	bufferBytes int
+	// maxEncodedRatio is the largest ratio of encoded to unencoded size that is worth sending for buffered responses
+	maxEncodedRatio float64
 	// maxDecodeSteps specifies how many layers of compression we will attempt to undo for Content-Encoding headers
 	// that specify multiple
 	maxDecodeSteps int
 	// skipDecompressRequest can be used to skip decompression of the body
 	skipDecompressRequest bool
+	// decompressNoTransform specifies whether to decompress bodies of requests with Cache-Control: no-transform
+	decompressNoTransform bool
+	// maxDecompressedBytes limits the size of the decompressed request body, <= 0 means unlimited
+	maxDecompressedBytes int64
+	// maxDecompressionRatio limits the ratio of decompressed to compressed request body bytes, <= 0 means unlimited
+	maxDecompressionRatio float64
+	// minDecompressionRatioBytes is the decompressed size below which maxDecompressionRatio is not enforced
+	minDecompressionRatioBytes int64
+	// strictDecompression causes requests with a Content-Encoding that cannot be fully decoded to be rejected
+	strictDecompression bool
+	// strictNegotiation causes requests that refuse identity without accepting any enabled algorithm to be rejected
+	strictNegotiation bool
+	// notAcceptableHandler is called to respond to requests rejected by strictNegotiation
+	notAcceptableHandler gin.HandlerFunc
+	// errorHandler is called when a response could not be written, if set
+	errorHandler ErrorHandler
+	// abortOnError causes the connection to be aborted when a response could not be written
+	abortOnError bool
 }
 
 type CompressOption func(opts *compressOptions)
@@ -44,16 +106,75 @@ func newCompressOptions() *compressOptions {
 		excludeFunc: func(c *gin.Context) bool {
 			return false
 		},
-		minCompressBytes:      512,
-		maxDecodeSteps:        1,
-		skipDecompressRequest: false,
+		algorithms:                 newAlgorithms(),
+		chooser:                    nil,
+		leveledAlgorithms:          &leveledAlgorithms{algos: make(map[leveledAlgorithm]Algorithm)},
+		statusFunc:                 nil,
+		includeContentTypes:        nil,
+		excludeContentTypes:        normalizeContentTypes(DefaultExcludedContentTypes),
+		eventStreams:               false,
+		eventStreamFlush:           FlushOnEvent,
+		eventStreamFlushInterval:   100 * time.Millisecond,
+		rangePolicy:                RangeSkip,
+		etagPolicy:                 ETagSuffix,
+		minCompressBytes:           512,
+		maxCompressBytes:           0,
+		largeAlgorithms:            make(map[string]Algorithm),
+		bufferBytes:                0,
+		maxEncodedRatio:            1,
+		maxDecodeSteps:             1,
+		skipDecompressRequest:      false,
+		decompressNoTransform:      true,
+		maxDecompressedBytes:       0,
+		maxDecompressionRatio:      0,
+		minDecompressionRatioBytes: 64 * 1024,
+		strictDecompression:        false,
+		strictNegotiation:          false,
+		notAcceptableHandler: func(c *gin.Context) {
+			c.AbortWithStatus(406)
+		},
+		errorHandler: nil,
+		abortOnError: false,
 	}
 }
 
+// algorithm returns the algorithm of this middleware named name. It panics if there is none, as option was given
+// an algorithm that doesn't exist.
+func (opts *compressOptions) algorithm(option string, name string) Algorithm {
+	algo, ok := opts.algorithms[strings.ToLower(name)]
+	if !ok {
+		panic(option + " requires an algorithm of this middleware, but there is none named " + name)
+	}
+
+	return algo
+}
+
 // WithAlgo specifies whether algo should be enabled for both compression and decompression
 func WithAlgo(algo string, enable bool) CompressOption {
 	return func(opts *compressOptions) {
-		algorithms[algo].getConfig().enable = enable
+		opts.algorithm("WithAlgo", algo).GetConfig().Enable = enable
+	}
+}
+
+// WithAlgorithm adds algo to this middleware under the content coding name, replacing any algorithm that was
+// registered with the same name. name must be a token other than identity, * or x-gzip. Options that refer to name
+// (e.g. WithAlgo) must come after this option.
+func WithAlgorithm(name string, algo Algorithm) CompressOption {
+	if !isAlgorithmName(name) || algo == nil {
+		panic("WithAlgorithm requires a valid content coding name and a non-nil algorithm")
+	}
+
+	return func(opts *compressOptions) {
+		opts.algorithms[strings.ToLower(name)] = algo
+	}
+}
+
+// WithAlgorithmChooser defers the choice of coding until the response is large enough to compress, and lets chooser
+// make it based on the response. Without a chooser, the candidate with the highest q-value and priority is used.
+// WithMaxCompressBytes still applies to the chosen coding.
+func WithAlgorithmChooser(chooser AlgorithmChooser) CompressOption {
+	return func(opts *compressOptions) {
+		opts.chooser = chooser
 	}
 }
 
@@ -71,7 +192,7 @@ const (
 // is valid for the algorithm you've selected.
 func WithCompressLevel(algo string, level int) CompressOption {
 	return func(opts *compressOptions) {
-		algorithms[algo].getConfig().compressLevel = level
+		opts.algorithm("WithCompressLevel", algo).GetConfig().CompressLevel = level
 	}
 }
 
@@ -79,7 +200,7 @@ func WithCompressLevel(algo string, level int) CompressOption {
 // The highest priority algorithm that the client will accept wins.
 func WithPriority(algo string, priority int) CompressOption {
 	return func(opts *compressOptions) {
-		algorithms[algo].getConfig().priority = priority
+		opts.algorithm("WithPriority", algo).GetConfig().Priority = priority
 	}
 }
 
@@ -91,6 +212,82 @@ func WithExcludeFunc(f func(c *gin.Context) bool) CompressOption {
 	}
 }
 
+// WithStatusFunc restricts compression to responses whose status code f returns true for. It is called once the
+// response is large enough to compress, so the status set by the handler is known.
+func WithStatusFunc(f StatusFunc) CompressOption {
+	return func(opts *compressOptions) {
+		opts.statusFunc = f
+	}
+}
+
+// WithStatusCodes restricts compression to responses with one of the given status codes. This replaces WithStatusFunc.
+func WithStatusCodes(codes ...int) CompressOption {
+	allowed := make(map[int]bool, len(codes))
+	for _, code := range codes {
+		allowed[code] = true
+	}
+
+	return WithStatusFunc(func(status int) bool {
+		return allowed[status]
+	})
+}
+
+// WithIncludeContentTypes restricts compression to responses whose Content-Type matches one of the given media types.
+// Patterns may use * to match anything but a /, such as text/* or application/*+json.
+func WithIncludeContentTypes(types ...string) CompressOption {
+	types = normalizeContentTypes(types)
+
+	return func(opts *compressOptions) {
+		opts.includeContentTypes = types
+	}
+}
+
+// WithExcludeContentTypes prevents responses whose Content-Type matches one of the given media types from being
+// compressed. This replaces DefaultExcludedContentTypes, so include them if they should still apply.
+// Patterns use the same syntax as WithIncludeContentTypes.
+func WithExcludeContentTypes(types ...string) CompressOption {
+	types = normalizeContentTypes(types)
+
+	return func(opts *compressOptions) {
+		opts.excludeContentTypes = types
+	}
+}
+
+// WithEventStreams enables compressing Server-Sent Events (text/event-stream responses), which are otherwise left
+// unencoded. Event streams are encoded from the first write and the compressor is flushed according to flush.
+func WithEventStreams(flush EventStreamFlush) CompressOption {
+	return func(opts *compressOptions) {
+		opts.eventStreams = true
+		opts.eventStreamFlush = flush
+	}
+}
+
+// WithEventStreamFlushInterval specifies how long data may sit in the compressor when using FlushOnInterval.
+func WithEventStreamFlushInterval(interval time.Duration) CompressOption {
+	if interval <= 0 {
+		panic("interval <= 0, use FlushOnWrite to flush immediately")
+	}
+
+	return func(opts *compressOptions) {
+		opts.eventStreamFlushInterval = interval
+	}
+}
+
+// WithRangePolicy specifies how requests with a Range header are handled, see RangePolicy. The default is RangeSkip.
+func WithRangePolicy(policy RangePolicy) CompressOption {
+	return func(opts *compressOptions) {
+		opts.rangePolicy = policy
+	}
+}
+
+// WithETagPolicy specifies how strong ETags are changed when a response is encoded, see ETagPolicy.
+// The default is ETagSuffix.
+func WithETagPolicy(policy ETagPolicy) CompressOption {
+	return func(opts *compressOptions) {
+		opts.etagPolicy = policy
+	}
+}
+
 // WithMinCompressBytes specifies the minimum size a response must be before compressing.
 // Using a value <= 0 will always compress.
 func WithMinCompressBytes(numBytes int) CompressOption {
@@ -99,6 +296,52 @@ func WithMinCompressBytes(numBytes int) CompressOption {
 	}
 }
 
+// WithMaxCompressBytes specifies the size above which responses are sent unencoded, unless a cheaper level was
+// configured with WithLargeCompressLevel. The size is taken from the Content-Length set by the handler, or else from the
+// number of bytes written before encoding starts (see WithMinCompressBytes and WithBufferedCompression), so responses
+// streamed without a Content-Length may exceed it. Using a value <= 0 disables the limit.
+func WithMaxCompressBytes(numBytes int64) CompressOption {
+	return func(opts *compressOptions) {
+		opts.maxCompressBytes = numBytes
+	}
+}
+
+// WithLargeCompressLevel specifies a compression level for algo that is used for responses larger than
+// WithMaxCompressBytes, instead of sending them unencoded. algo must implement Leveler, and options that replace it
+// (e.g. WithAlgorithm) must come before this option.
+func WithLargeCompressLevel(algo string, level int) CompressOption {
+	return func(opts *compressOptions) {
+		large := withLevel(opts.algorithm("WithLargeCompressLevel", algo), level)
+		if large == nil {
+			panic("WithLargeCompressLevel requires an algorithm that implements Leveler")
+		}
+		opts.largeAlgorithms[strings.ToLower(algo)] = large
+	}
+}
+
+// WithBufferedCompression buffers responses of up to numBytes and compresses them in memory once the handler is done,
+// so that an accurate Content-Length can be sent. Larger responses are compressed as they are written.
+// Using a value <= 0 disables buffering beyond WithMinCompressBytes.
+func WithBufferedCompression(numBytes int) CompressOption {
+	return func(opts *compressOptions) {
+		opts.bufferBytes = numBytes
+	}
+}
+
+// WithMaxEncodedRatio specifies how much smaller a response buffered by WithBufferedCompression must become for the
+// encoded body to be sent. Responses whose encoded size is not less than ratio times their original size are sent
+// unencoded. The default of 1 only requires the encoded body to be smaller. ratio must be greater than 0, and values
+// above 1 allow encoded bodies that are larger than the original.
+func WithMaxEncodedRatio(ratio float64) CompressOption {
+	if !(ratio > 0) {
+		panic("ratio <= 0, every buffered response would be sent unencoded")
+	}
+
+	return func(opts *compressOptions) {
+		opts.maxEncodedRatio = ratio
+	}
+}
+
 // WithMaxDecodeSteps specifies how many layers of request body compression to undo if multiple.
 func WithMaxDecodeSteps(steps int) CompressOption {
 	if steps < 1 {
@@ -116,3 +359,81 @@ func WithDecompressBody(decompress bool) CompressOption {
 		opts.skipDecompressRequest = !decompress
 	}
 }
+
+// WithDecompressNoTransform specifies whether to decompress the body of requests with Cache-Control: no-transform.
+// When disabled, such bodies are passed to the handler exactly as they were sent, along with their Content-Encoding.
+func WithDecompressNoTransform(decompress bool) CompressOption {
+	return func(opts *compressOptions) {
+		opts.decompressNoTransform = decompress
+	}
+}
+
+// WithMaxDecompressedBytes limits the number of bytes that may be read from a decompressed request body.
+// Reading past the limit returns a *DecompressionLimitError and the middleware responds with 413 Request Entity Too Large
+// if the handler has not written a response. Using a value <= 0 disables the limit.
+func WithMaxDecompressedBytes(numBytes int64) CompressOption {
+	return func(opts *compressOptions) {
+		opts.maxDecompressedBytes = numBytes
+	}
+}
+
+// WithMaxDecompressionRatio limits how many times larger a decompressed request body may be than the bytes received
+// from the client. Exceeding the ratio is handled like WithMaxDecompressedBytes. Using a value <= 0 disables the limit.
+// The ratio is only enforced once the body is larger than WithMinDecompressionRatioBytes.
+func WithMaxDecompressionRatio(ratio float64) CompressOption {
+	return func(opts *compressOptions) {
+		opts.maxDecompressionRatio = ratio
+	}
+}
+
+// WithMinDecompressionRatioBytes specifies how many bytes may be decompressed before WithMaxDecompressionRatio is
+// enforced, since small bodies can legitimately compress very well. The default is 64 KiB.
+func WithMinDecompressionRatioBytes(numBytes int64) CompressOption {
+	return func(opts *compressOptions) {
+		opts.minDecompressionRatioBytes = numBytes
+	}
+}
+
+// WithStrictDecompression specifies whether requests with a Content-Encoding that cannot be fully decoded should be
+// rejected. Codings that are unknown or disabled are rejected with 415 Unsupported Media Type, and the response carries
+// an Accept-Encoding header listing the codings that can be decoded, as described by RFC 7694. Requests that only
+// exceed WithMaxDecodeSteps are rejected with 400 Bad Request.
+func WithStrictDecompression(strict bool) CompressOption {
+	return func(opts *compressOptions) {
+		opts.strictDecompression = strict
+	}
+}
+
+// WithStrictNegotiation specifies whether requests that forbid unencoded responses (identity;q=0 or *;q=0) without
+// accepting any enabled algorithm should be rejected with 406 Not Acceptable. When enabled, responses to clients that
+// forbid identity are encoded regardless of WithMinCompressBytes.
+func WithStrictNegotiation(strict bool) CompressOption {
+	return func(opts *compressOptions) {
+		opts.strictNegotiation = strict
+	}
+}
+
+// WithNotAcceptableHandler specifies the handler used to respond to requests rejected by WithStrictNegotiation.
+// The request is aborted after the handler returns.
+func WithNotAcceptableHandler(h gin.HandlerFunc) CompressOption {
+	return func(opts *compressOptions) {
+		opts.notAcceptableHandler = h
+	}
+}
+
+// WithErrorHandler specifies a function that is called with the first error encountered while writing a response,
+// such as a failing compressor. The error is also recorded with c.Error.
+func WithErrorHandler(h ErrorHandler) CompressOption {
+	return func(opts *compressOptions) {
+		opts.errorHandler = h
+	}
+}
+
+// WithAbortOnError specifies whether the connection should be closed when a response could not be written, once the
+// error has been reported. This ensures clients cannot mistake the response for a complete one. Connections that can't
+// be hijacked (e.g. HTTP/2) are aborted by panicking with http.ErrAbortHandler instead, which must reach net/http.
+func WithAbortOnError(abort bool) CompressOption {
+	return func(opts *compressOptions) {
+		opts.abortOnError = abort
+	}
+}
@@ -0,0 +1,38 @@
+package compress
+
+/*
+gin-compress Copyright (C) 2022 Aurora McGinnis
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RangePolicy determines how the middleware deals with range requests. Partial responses (206 Partial Content, or
+// any response with Content-Range) are never encoded under either policy, since their byte ranges refer to the
+// unencoded representation.
+type RangePolicy int
+
+const (
+	// RangeSkip leaves responses to requests with a Range header unencoded
+	RangeSkip RangePolicy = iota
+	// RangeStripAcceptRanges encodes responses to range requests that the handler answered in full, and removes
+	// Accept-Ranges from encoded responses so that clients do not request ranges of the encoded representation
+	RangeStripAcceptRanges
+)
+
+// skipRange returns true if the request is a range request that should be left unencoded
+func (cm *compressMiddleware) skipRange(c *gin.Context) bool {
+	return cm.cfg.rangePolicy == RangeSkip && c.GetHeader("Range") != ""
+}
+
+// isPartial returns true if the response only contains part of the representation
+func (rw *respWriter) isPartial() bool {
+	return rw.Status() == http.StatusPartialContent || rw.Header().Get("Content-Range") != ""
+}
@@ -0,0 +1,60 @@
+package compress
+
+/*
+gin-compress Copyright (C) 2022 Aurora McGinnis
+
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at https://mozilla.org/MPL/2.0/.
+*/
+
+// ResultKey is the gin context key under which an *EncodingResult is stored once the response has been written.
+// Middleware that runs before Compress can read it after calling c.Next(), e.g. to record metrics.
+const ResultKey = "github.com/aurowora/compress/result"
+
+// Decision describes whether a response was encoded, and if not, why
+type Decision string
+
+const (
+	// DecisionEncoded means the response was encoded
+	DecisionEncoded Decision = "encoded"
+	// DecisionNotAccepted means the client did not accept any enabled algorithm
+	DecisionNotAccepted Decision = "not-accepted"
+	// DecisionExcluded means the request was excluded by WithExcludeFunc, or was an upgrade or event stream
+	DecisionExcluded Decision = "excluded"
+	// DecisionTooSmall means the response was smaller than WithMinCompressBytes
+	DecisionTooSmall Decision = "too-small"
+	// DecisionTooLarge means the response was larger than WithMaxCompressBytes
+	DecisionTooLarge Decision = "too-large"
+	// DecisionChooser means the AlgorithmChooser chose to send the response unencoded
+	DecisionChooser Decision = "chooser"
+	// DecisionNotSmaller means the encoded response was not sufficiently smaller, see WithMaxEncodedRatio
+	DecisionNotSmaller Decision = "not-smaller"
+	// DecisionContentType means the Content-Type of the response is not compressed
+	DecisionContentType Decision = "content-type"
+	// DecisionHandlerEncoded means the handler set Content-Encoding itself
+	DecisionHandlerEncoded Decision = "handler-encoded"
+	// DecisionNoTransform means the request or response had Cache-Control: no-transform
+	DecisionNoTransform Decision = "no-transform"
+	// DecisionRange means the request had a Range header and RangeSkip was in effect, or the response was partial
+	DecisionRange Decision = "range"
+	// DecisionStatus means the response status is not compressed, see WithStatusFunc
+	DecisionStatus Decision = "status"
+	// DecisionBodiless means the response status does not allow a body
+	DecisionBodiless Decision = "bodiless"
+)
+
+// EncodingResult describes how the middleware handled a response
+type EncodingResult struct {
+	// Decision describes whether the response was encoded, and if not, why
+	Decision Decision
+	// Encoding is the content coding that was applied, or "" if the response was not encoded
+	Encoding string
+	// Size is the number of bytes written by the handler, before encoding
+	Size int
+	// EncodedSize is the size of the encoded body. It is only known for responses encoded in memory, and is -1 otherwise.
+	EncodedSize int
+	// Err is the first error encountered while writing the response, which means the client received an incomplete
+	// response
+	Err error
+}
@@ -26,12 +26,12 @@ const (
 type algorithmZstd struct {
 	compressorPool   *sync.Pool
 	decompressorPool *sync.Pool
-	cfg              algorithmConfig
+	cfg              AlgorithmConfig
 }
 
 // makeCompressor allocates a new ZSTD encoder (not for direct use)
 func (a *algorithmZstd) makeCompressor() interface{} {
-	z, err := zstd.NewWriter(ioutil.Discard, zstd.WithEncoderLevel(zstd.EncoderLevel(a.cfg.compressLevel)))
+	z, err := zstd.NewWriter(ioutil.Discard, zstd.WithEncoderLevel(zstd.EncoderLevel(a.cfg.CompressLevel)))
 	if err != nil {
 		panic(err)
 	}
@@ -39,13 +39,13 @@ func (a *algorithmZstd) makeCompressor() interface{} {
 	return z
 }
 
-/* Implement algorithm */
+/* Implement Algorithm */
 
-func (a *algorithmZstd) getConfig() *algorithmConfig {
+func (a *algorithmZstd) GetConfig() *AlgorithmConfig {
 	return &a.cfg
 }
 
-func (a *algorithmZstd) getWriter(w io.Writer) io.WriteCloser {
+func (a *algorithmZstd) GetWriter(w io.Writer) io.WriteCloser {
 	zw := a.compressorPool.Get().(*zstd.Encoder)
 	zw.Reset(w)
 
@@ -55,24 +55,34 @@ func (a *algorithmZstd) getWriter(w io.Writer) io.WriteCloser {
 	}
 }
 
-func (a *algorithmZstd) getReader(r io.Reader) io.ReadCloser {
+func (a *algorithmZstd) GetReader(r io.Reader) (io.ReadCloser, error) {
 	zr := a.decompressorPool.Get().(*zstd.Decoder)
 	if err := zr.Reset(r); err != nil {
-		panic(err)
+		a.decompressorPool.Put(zr)
+		return nil, err
 	}
 
 	return &wrappedReader{
 		p: a.decompressorPool,
 		r: zr,
-	}
+	}, nil
+}
+
+// WithLevel returns a new zstd algorithm with the same configuration and its own pools, which uses level
+func (a *algorithmZstd) WithLevel(level int) Algorithm {
+	b := newAlgorithmZstd()
+	b.cfg = a.cfg
+	b.cfg.CompressLevel = level
+
+	return b
 }
 
 func newAlgorithmZstd() *algorithmZstd {
 	a := algorithmZstd{
-		cfg: algorithmConfig{
-			priority:      100,
-			enable:        true,
-			compressLevel: ZstdSpeedDefault,
+		cfg: AlgorithmConfig{
+			Priority:      100,
+			Enable:        true,
+			CompressLevel: ZstdSpeedDefault,
 		},
 		decompressorPool: &sync.Pool{
 			New: func() interface{} {